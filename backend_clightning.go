@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	lightning "github.com/fiatjaf/lightningd-gjson-rpc"
+	"github.com/tidwall/gjson"
+)
+
+func init() {
+	RegisterBackendKind("clightning", BackendKind{
+		New: func(id string, conn gjson.Result) LightningBackend {
+			return &CLightningBackend{
+				path: conn.Get("path").String(),
+			}
+		},
+		Validate: func(conn gjson.Result) error {
+			return requireStrings(conn, []string{"path"}, nil)
+		},
+	})
+}
+
+// CLightningBackend talks to lightningd directly through its JSON-RPC unix
+// socket, so it only works when lnurlpayserver runs on the same machine.
+type CLightningBackend struct {
+	path string
+}
+
+func (cln *CLightningBackend) client(timeout time.Duration) *lightning.Client {
+	return &lightning.Client{
+		Path:        cln.path,
+		CallTimeout: timeout,
+	}
+}
+
+func (cln *CLightningBackend) label(hash string) string {
+	return "lnurlpayserver/" + hash
+}
+
+func (cln *CLightningBackend) MakeInvoice(
+	msatoshi int64,
+	description string,
+	preimage []byte,
+	expiry int,
+) (bolt11 string, err error) {
+	hash := sha256.Sum256(preimage)
+	inv, err := cln.client(time.Second*5).CallNamed("invoice",
+		"amount_msat", msatoshi,
+		"label", cln.label(hex.EncodeToString(hash[:])),
+		"description", description,
+		"expiry", expiry,
+		"preimage", hex.EncodeToString(preimage),
+		// put only the description_hash in the invoice
+		"deschashonly", true,
+	)
+	if err != nil {
+		return "", fmt.Errorf("invoice call failed: %w", err)
+	}
+	return inv.Get("bolt11").String(), nil
+}
+
+func (cln *CLightningBackend) status(hash string) (gjson.Result, error) {
+	res, err := cln.client(time.Second*10).CallNamed("listinvoices",
+		"label", cln.label(hash))
+	if err != nil {
+		return res, fmt.Errorf("listinvoices call failed: %w", err)
+	}
+	return res.Get("invoices.0"), nil
+}
+
+// clnInvoiceStatus reads invoices as returned by lightningd, also used by spark.
+func clnInvoiceStatus(inv gjson.Result) InvoiceStatus {
+	if inv.Get("status").String() != "paid" {
+		return InvoiceStatus{}
+	}
+
+	amount := inv.Get("amount_received_msat")
+	if !amount.Exists() {
+		// older versions
+		amount = inv.Get("msatoshi_received")
+	}
+
+	return InvoiceStatus{
+		Paid:           true,
+		AmountPaidMsat: parseMsat(amount),
+		SettledAt:      unixTime(inv.Get("paid_at")),
+		Preimage:       inv.Get("payment_preimage").String(),
+	}
+}
+
+func (cln *CLightningBackend) CheckInvoice(hash string) (InvoiceStatus, error) {
+	inv, err := cln.status(hash)
+	if err != nil {
+		return InvoiceStatus{}, err
+	}
+	return clnInvoiceStatus(inv), nil
+}
+
+func (cln *CLightningBackend) WaitInvoice(ctx context.Context, hash string) (InvoiceStatus, error) {
+	timeout := time.Minute * 15
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+
+	res, err := cln.client(timeout).Call("waitinvoice", cln.label(hash))
+	if err != nil {
+		// waitinvoice also fails when the invoice expires
+		if inv, _ := cln.status(hash); inv.Get("status").String() == "expired" {
+			return InvoiceStatus{}, nil
+		}
+		return InvoiceStatus{}, fmt.Errorf("error on waitinvoice: %w", err)
+	}
+
+	return clnInvoiceStatus(res), nil
+}
+
+// hold invoices need the holdinvoice plugin, whose holdinvoice command takes
+// the same parameters as invoice, except for the label, and either the
+// payment_hash or the preimage.
+
+func (cln *CLightningBackend) MakeHoldInvoice(
+	msatoshi int64,
+	description string,
+	preimage []byte,
+	expiry int,
+) (bolt11 string, err error) {
+	inv, err := cln.client(time.Second*5).CallNamed("holdinvoice",
+		"amount_msat", msatoshi,
+		"description", description,
+		"expiry", expiry,
+		"preimage", hex.EncodeToString(preimage),
+		"deschashonly", true,
+	)
+	if err != nil {
+		return "", fmt.Errorf("holdinvoice call failed: %w", err)
+	}
+	return inv.Get("bolt11").String(), nil
+}
+
+// plugin versions name the states differently
+var clnHoldStates = map[string]string{
+	"open":      HOLD_OPEN,
+	"unpaid":    HOLD_OPEN,
+	"accepted":  HOLD_ACCEPTED,
+	"settled":   HOLD_SETTLED,
+	"paid":      HOLD_SETTLED,
+	"canceled":  HOLD_CANCELED,
+	"cancelled": HOLD_CANCELED,
+}
+
+func (cln *CLightningBackend) HoldInvoiceState(hash string) (string, error) {
+	res, err := cln.client(time.Second*10).CallNamed("holdinvoicelookup",
+		"payment_hash", hash)
+	if err != nil {
+		return "", fmt.Errorf("holdinvoicelookup call failed: %w", err)
+	}
+
+	state := res.Get("state").String()
+	if hold, ok := clnHoldStates[strings.ToLower(state)]; ok {
+		return hold, nil
+	}
+	return "", fmt.Errorf("unknown hold invoice state %q", state)
+}
+
+func (cln *CLightningBackend) SettleHoldInvoice(preimage []byte) error {
+	hash := sha256.Sum256(preimage)
+	_, err := cln.client(time.Second*10).CallNamed("holdinvoicesettle",
+		"payment_hash", hex.EncodeToString(hash[:]))
+	return err
+}
+
+func (cln *CLightningBackend) CancelHoldInvoice(hash string) error {
+	_, err := cln.client(time.Second*10).CallNamed("holdinvoicecancel",
+		"payment_hash", hash)
+	return err
+}
+
+func (cln *CLightningBackend) Healthcheck(ctx context.Context) error {
+	_, err := cln.client(time.Second * 10).Call("getinfo")
+	return err
+}
+
+func (cln *CLightningBackend) GetNodeId() (string, error) {
+	info, err := cln.client(time.Second * 5).Call("getinfo")
+	if err != nil {
+		return "", fmt.Errorf("getinfo call failed: %w", err)
+	}
+	return info.Get("id").String(), nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/tidwall/gjson"
+)
+
+func init() {
+	RegisterBackendKind("eclair", BackendKind{
+		New: func(id string, conn gjson.Result) LightningBackend {
+			return &EclairBackend{
+				url:      strings.TrimSuffix(conn.Get("url").String(), "/"),
+				password: conn.Get("password").String(),
+			}
+		},
+		Validate: func(conn gjson.Result) error {
+			return requireStrings(conn, []string{"url", "password"}, nil)
+		},
+		Secrets: []string{"password"},
+	})
+}
+
+type EclairBackend struct {
+	url      string
+	password string
+}
+
+var eclairClient = &http.Client{Timeout: time.Second * 15}
+
+func (eclair *EclairBackend) call(
+	ctx context.Context,
+	method string,
+	params url.Values,
+) (gjson.Result, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", eclair.url+"/"+method,
+		strings.NewReader(params.Encode()))
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	req.SetBasicAuth("", eclair.password)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := eclairClient.Do(req)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+
+	res := gjson.ParseBytes(b)
+	if resp.StatusCode >= 300 {
+		return res, fmt.Errorf("eclair %s failed (%d): %s",
+			method, resp.StatusCode, res.Get("error").String())
+	}
+	return res, nil
+}
+
+func (eclair *EclairBackend) MakeInvoice(
+	msatoshi int64,
+	description string,
+	preimage []byte,
+	expiry int,
+) (bolt11 string, err error) {
+	h := sha256.Sum256([]byte(description))
+
+	inv, err := eclair.call(context.Background(), "createinvoice", url.Values{
+		"amountMsat":      {strconv.FormatInt(msatoshi, 10)},
+		"descriptionHash": {hex.EncodeToString(h[:])},
+		"expireIn":        {strconv.Itoa(expiry)},
+		"paymentPreimage": {hex.EncodeToString(preimage)},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return inv.Get("serialized").String(), nil
+}
+
+// status returns "pending", "received" or "expired" and the payment details.
+func (eclair *EclairBackend) status(ctx context.Context, hash string) (string, InvoiceStatus, error) {
+	info, err := eclair.call(ctx, "getreceivedinfo", url.Values{
+		"paymentHash": {hash},
+	})
+	if err != nil {
+		return "", InvoiceStatus{}, err
+	}
+
+	status := info.Get("status.type").String()
+	if status != "received" {
+		return status, InvoiceStatus{}, nil
+	}
+
+	// newer versions have {"unix": ..., "iso": ...}, older ones milliseconds
+	settledAt := unixTime(info.Get("status.receivedAt.unix"))
+	if ms := info.Get("status.receivedAt"); ms.Type == gjson.Number {
+		settledAt = time.Unix(0, ms.Int()*int64(time.Millisecond))
+	}
+
+	return status, InvoiceStatus{
+		Paid:           true,
+		AmountPaidMsat: info.Get("status.amount").Int(),
+		SettledAt:      settledAt,
+		Preimage:       info.Get("paymentPreimage").String(),
+	}, nil
+}
+
+func (eclair *EclairBackend) CheckInvoice(hash string) (InvoiceStatus, error) {
+	_, status, err := eclair.status(context.Background(), hash)
+	return status, err
+}
+
+func (eclair *EclairBackend) WaitInvoice(ctx context.Context, hash string) (InvoiceStatus, error) {
+	sub := subscriptionFor("eclair:"+eclair.url, eclair.listen)
+	wake, done := sub.wait(hash)
+	defer done()
+
+	for {
+		state, status, err := eclair.status(ctx, hash)
+		if err != nil {
+			return InvoiceStatus{}, err
+		}
+		switch state {
+		case "received":
+			return status, nil
+		case "expired":
+			return InvoiceStatus{}, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return InvoiceStatus{}, nil
+		case <-wake:
+		}
+	}
+}
+
+// listen reads payment events from eclair's websocket.
+func (eclair *EclairBackend) listen(ctx context.Context, sub *invoiceSubscription) error {
+	wsURL := "ws" + strings.TrimPrefix(eclair.url, "http") + "/ws"
+	header := http.Header{}
+	header.Set("Authorization", "Basic "+
+		base64.StdEncoding.EncodeToString([]byte(":"+eclair.password)))
+
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, wsURL, header)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	// we may have missed payments while we were disconnected
+	sub.resync()
+
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		event := gjson.ParseBytes(message)
+		if event.Get("type").String() == "payment-received" {
+			sub.notify(event.Get("paymentHash").String())
+		}
+	}
+}
+
+func (eclair *EclairBackend) Healthcheck(ctx context.Context) error {
+	_, err := eclair.call(ctx, "getinfo", url.Values{})
+	return err
+}
+
+func (eclair *EclairBackend) GetNodeId() (string, error) {
+	info, err := eclair.call(context.Background(), "getinfo", url.Values{})
+	if err != nil {
+		return "", err
+	}
+	nodeId := info.Get("nodeId").String()
+	if nodeId == "" {
+		return "", errors.New("eclair getinfo returned no nodeId")
+	}
+	return nodeId, nil
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/btcsuite/btcd/btcutil/bech32"
+	cmap "github.com/orcaman/concurrent-map"
+	"github.com/tidwall/gjson"
+)
+
+func init() {
+	RegisterBackendKind("fake", BackendKind{
+		New: func(id string, conn gjson.Result) LightningBackend {
+			sk := sha256.Sum256([]byte(conn.Get("seed").String()))
+			key, _ := btcec.PrivKeyFromBytes(sk[:])
+
+			return &FakeBackend{
+				key:   key,
+				delay: time.Duration(conn.Get("delay").Float() * float64(time.Second)),
+			}
+		},
+		Validate: func(conn gjson.Result) error {
+			if v := conn.Get("delay"); v.Exists() && v.Type != gjson.Number {
+				return errors.New("connection.delay must be a number")
+			}
+			return requireStrings(conn, []string{"seed"}, nil)
+		},
+		Secrets: []string{"seed"},
+		// each shop gets its own node unless they share a seed
+		Defaults: func(shopId string) map[string]string {
+			return map[string]string{"seed": "lnurlpayserver:" + shopId}
+		},
+		Enabled: func() bool { return s.FakeBackend },
+	})
+}
+
+// FakeBackend makes invoices signed by a local key that no one can pay. They
+// are marked as paid after the configured delay (if any) or by calling
+// fakePayInvoice. It's meant for development, demos and tests.
+type FakeBackend struct {
+	key   *btcec.PrivateKey
+	delay time.Duration
+}
+
+type fakeInvoice struct {
+	expiresAt time.Time
+	hold      bool
+	state     string // one of HOLD_*, also for normal invoices
+	msatoshi  int64
+	preimage  string
+
+	amountPaid int64
+	paidAt     time.Time
+}
+
+// all fake invoices from all fake backends, by hash
+var fakeInvoices = cmap.New()
+
+// fakePayInvoice pays the invoice with the given amount, or the exact
+// invoice amount when it's 0.
+func fakePayInvoice(hash string, msatoshi int64) error {
+	v, ok := fakeInvoices.Get(hash)
+	if !ok {
+		return errors.New("fake invoice not found")
+	}
+	inv := v.(fakeInvoice)
+	if inv.state != HOLD_OPEN {
+		return errors.New("fake invoice is " + inv.state)
+	}
+	if time.Now().After(inv.expiresAt) {
+		return errors.New("fake invoice is expired")
+	}
+	if msatoshi == 0 {
+		msatoshi = inv.msatoshi
+	}
+	if msatoshi < inv.msatoshi {
+		return errors.New("amount is less than the invoice amount")
+	}
+
+	inv.amountPaid = msatoshi
+	inv.paidAt = time.Now()
+
+	if inv.hold {
+		inv.state = HOLD_ACCEPTED
+	} else {
+		inv.state = HOLD_SETTLED
+	}
+	fakeInvoices.Set(hash, inv)
+
+	subscriptionFor("fake", listenFake).notify(hash)
+	return nil
+}
+
+func listenFake(ctx context.Context, sub *invoiceSubscription) error {
+	// fakePayInvoice notifies directly, there's nothing to listen to
+	<-ctx.Done()
+	return nil
+}
+
+func (fake *FakeBackend) MakeInvoice(
+	msatoshi int64,
+	description string,
+	preimage []byte,
+	expiry int,
+) (bolt11 string, err error) {
+	return fake.makeInvoice(msatoshi, description, preimage, expiry, false)
+}
+
+func (fake *FakeBackend) MakeHoldInvoice(
+	msatoshi int64,
+	description string,
+	preimage []byte,
+	expiry int,
+) (bolt11 string, err error) {
+	return fake.makeInvoice(msatoshi, description, preimage, expiry, true)
+}
+
+func (fake *FakeBackend) makeInvoice(
+	msatoshi int64,
+	description string,
+	preimage []byte,
+	expiry int,
+	hold bool,
+) (bolt11 string, err error) {
+	hash := sha256.Sum256(preimage)
+	h := sha256.Sum256([]byte(description))
+
+	bolt11, err = encodeBolt11(fake.key, msatoshi, hash, h, expiry, time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	hashStr := hex.EncodeToString(hash[:])
+	fakeInvoices.Set(hashStr, fakeInvoice{
+		expiresAt: time.Now().Add(time.Duration(expiry) * time.Second),
+		hold:      hold,
+		state:     HOLD_OPEN,
+		msatoshi:  msatoshi,
+		preimage:  hex.EncodeToString(preimage),
+	})
+
+	if fake.delay > 0 {
+		time.AfterFunc(fake.delay, func() {
+			fakePayInvoice(hashStr, 0)
+		})
+	}
+
+	return bolt11, nil
+}
+
+func (fake *FakeBackend) status(hash string) (status InvoiceStatus, expired bool) {
+	state, _ := fake.HoldInvoiceState(hash)
+	if state == HOLD_SETTLED {
+		v, _ := fakeInvoices.Get(hash)
+		inv := v.(fakeInvoice)
+		status = InvoiceStatus{
+			Paid:           true,
+			AmountPaidMsat: inv.amountPaid,
+			SettledAt:      inv.paidAt,
+			Preimage:       inv.preimage,
+		}
+	}
+	return status, state == HOLD_CANCELED
+}
+
+func (fake *FakeBackend) HoldInvoiceState(hash string) (string, error) {
+	v, ok := fakeInvoices.Get(hash)
+	if !ok {
+		// we've forgotten about it, so it can't be paid anymore
+		return HOLD_CANCELED, nil
+	}
+	inv := v.(fakeInvoice)
+	if inv.state == HOLD_OPEN && time.Now().After(inv.expiresAt) {
+		return HOLD_CANCELED, nil
+	}
+	return inv.state, nil
+}
+
+func (fake *FakeBackend) setHoldState(hash string, from string, to string) error {
+	v, ok := fakeInvoices.Get(hash)
+	if !ok {
+		return errors.New("fake invoice not found")
+	}
+	inv := v.(fakeInvoice)
+	if inv.state != from {
+		return errors.New("fake invoice is " + inv.state)
+	}
+	inv.state = to
+	fakeInvoices.Set(hash, inv)
+	subscriptionFor("fake", listenFake).notify(hash)
+	return nil
+}
+
+func (fake *FakeBackend) SettleHoldInvoice(preimage []byte) error {
+	hash := sha256.Sum256(preimage)
+	return fake.setHoldState(hex.EncodeToString(hash[:]), HOLD_ACCEPTED, HOLD_SETTLED)
+}
+
+func (fake *FakeBackend) CancelHoldInvoice(hash string) error {
+	state, _ := fake.HoldInvoiceState(hash)
+	switch state {
+	case HOLD_CANCELED:
+		return nil
+	case HOLD_SETTLED:
+		return errors.New("fake invoice is already settled")
+	}
+	return fake.setHoldState(hash, state, HOLD_CANCELED)
+}
+
+func (fake *FakeBackend) CheckInvoice(hash string) (InvoiceStatus, error) {
+	status, _ := fake.status(hash)
+	return status, nil
+}
+
+func (fake *FakeBackend) WaitInvoice(ctx context.Context, hash string) (InvoiceStatus, error) {
+	wake, done := subscriptionFor("fake", listenFake).wait(hash)
+	defer done()
+
+	for {
+		status, expired := fake.status(hash)
+		if status.Paid || expired {
+			return status, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return InvoiceStatus{}, nil
+		case <-wake:
+		case <-time.After(time.Minute):
+			// check expiration
+		}
+	}
+}
+
+func (fake *FakeBackend) Healthcheck(ctx context.Context) error {
+	return nil
+}
+
+func (fake *FakeBackend) GetNodeId() (string, error) {
+	return hex.EncodeToString(fake.key.PubKey().SerializeCompressed()), nil
+}
+
+// encodeBolt11 writes a real bolt11 invoice according to BOLT #11, with
+// only the fields we need.
+func encodeBolt11(
+	key *btcec.PrivateKey,
+	msatoshi int64,
+	paymentHash [32]byte,
+	descriptionHash [32]byte,
+	expiry int,
+	timestamp time.Time,
+) (string, error) {
+	hrp := "lnbc"
+	switch {
+	case msatoshi%100000000 == 0:
+		hrp += strconv.FormatInt(msatoshi/100000000, 10) + "m"
+	case msatoshi%100000 == 0:
+		hrp += strconv.FormatInt(msatoshi/100000, 10) + "u"
+	case msatoshi%100 == 0:
+		hrp += strconv.FormatInt(msatoshi/100, 10) + "n"
+	default:
+		hrp += strconv.FormatInt(msatoshi*10, 10) + "p"
+	}
+
+	paymentSecret := make([]byte, 32)
+	rand.Read(paymentSecret)
+
+	data := bolt11Uint(uint64(timestamp.Unix()), 7)
+	for _, field := range []struct {
+		tag   byte
+		value []byte
+	}{
+		{1, bolt11Bytes(paymentHash[:])},      // p
+		{16, bolt11Bytes(paymentSecret)},      // s
+		{23, bolt11Bytes(descriptionHash[:])}, // h
+		{6, bolt11Uint(uint64(expiry), 0)},    // x
+		{24, bolt11Uint(18, 0)},               // c
+		{5, []byte{16, 8, 0}},                 // 9: var_onion_optin, payment_secret
+	} {
+		data = append(data, field.tag)
+		data = append(data, bolt11Uint(uint64(len(field.value)), 2)...)
+		data = append(data, field.value...)
+	}
+
+	// sign hrp plus the data in bytes
+	message, err := bech32.ConvertBits(data, 5, 8, true)
+	if err != nil {
+		return "", err
+	}
+	sighash := sha256.Sum256(append([]byte(hrp), message...))
+	compact, err := ecdsa.SignCompact(key, sighash[:], true)
+	if err != nil {
+		return "", err
+	}
+
+	// compact is <recovery id + 31><r><s>, bolt11 wants <r><s><recovery id>
+	signature := append(compact[1:], compact[0]-31)
+	data = append(data, bolt11Bytes(signature)...)
+
+	return bech32.Encode(hrp, data)
+}
+
+func bolt11Bytes(b []byte) []byte {
+	words, _ := bech32.ConvertBits(b, 8, 5, true)
+	return words
+}
+
+// bolt11Uint encodes v as big-endian 5-bit words, using exactly size words
+// or as few as needed when size is 0.
+func bolt11Uint(v uint64, size int) []byte {
+	var words []byte
+	for v > 0 || len(words) < size {
+		words = append([]byte{byte(v & 31)}, words...)
+		v >>= 5
+	}
+	if len(words) == 0 {
+		words = []byte{0}
+	}
+	return words
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	decodepay "github.com/fiatjaf/ln-decodepay"
+	"github.com/tidwall/gjson"
+)
+
+func newTestFake(seed string) *FakeBackend {
+	return backendKinds["fake"].New("", gjson.Parse(`{"seed": "`+seed+`"}`)).(*FakeBackend)
+}
+
+func TestEncodeBolt11RoundTrip(t *testing.T) {
+	fake := newTestFake("roundtrip")
+	payee, _ := fake.GetNodeId()
+
+	preimage := make([]byte, 32)
+	paymentHash := sha256.Sum256(preimage)
+	descriptionHash := sha256.Sum256([]byte(`[["text/plain","cookie"]]`))
+	timestamp := time.Unix(1600000000, 0)
+
+	for _, msatoshi := range []int64{
+		1, 999, 1000, 1234567, 100000, 21000000, 100000000, 250000000000,
+	} {
+		bolt11, err := encodeBolt11(fake.key, msatoshi, paymentHash, descriptionHash, 3600, timestamp)
+		if err != nil {
+			t.Fatalf("failed to encode %d msat: %s", msatoshi, err)
+		}
+
+		decoded, err := decodepay.Decodepay(bolt11)
+		if err != nil {
+			t.Fatalf("failed to decode %s: %s", bolt11, err)
+		}
+		if decoded.MSatoshi != msatoshi {
+			t.Errorf("%s: got %d msat, expected %d", bolt11, decoded.MSatoshi, msatoshi)
+		}
+		if decoded.PaymentHash != hex.EncodeToString(paymentHash[:]) {
+			t.Errorf("%s: got payment hash %s", bolt11, decoded.PaymentHash)
+		}
+		if decoded.DescriptionHash != hex.EncodeToString(descriptionHash[:]) {
+			t.Errorf("%s: got description hash %s", bolt11, decoded.DescriptionHash)
+		}
+		if decoded.Expiry != 3600 {
+			t.Errorf("%s: got expiry %d", bolt11, decoded.Expiry)
+		}
+		if decoded.CreatedAt != int(timestamp.Unix()) {
+			t.Errorf("%s: got timestamp %d", bolt11, decoded.CreatedAt)
+		}
+		if decoded.Payee != payee {
+			t.Errorf("%s: signed by %s, expected %s", bolt11, decoded.Payee, payee)
+		}
+	}
+}
+
+func TestFakeMakeInvoice(t *testing.T) {
+	fake := newTestFake("makeinvoice")
+	preimage := []byte("01234567890123456789012345678901")
+	hash := sha256.Sum256(preimage)
+	hashStr := hex.EncodeToString(hash[:])
+
+	bolt11, err := fake.MakeInvoice(5000, "description", preimage, 600)
+	if err != nil {
+		t.Fatalf("MakeInvoice failed: %s", err)
+	}
+	decoded, err := decodepay.Decodepay(bolt11)
+	if err != nil {
+		t.Fatalf("failed to decode: %s", err)
+	}
+	if decoded.PaymentHash != hashStr {
+		t.Errorf("got payment hash %s, expected %s", decoded.PaymentHash, hashStr)
+	}
+
+	if status, _ := fake.CheckInvoice(hashStr); status.Paid {
+		t.Fatal("invoice paid before being paid")
+	}
+	if err := fakePayInvoice(hashStr, 4000); err == nil {
+		t.Error("underpayment was accepted")
+	}
+	if err := fakePayInvoice(hashStr, 0); err != nil {
+		t.Fatalf("failed to pay: %s", err)
+	}
+	status, _ := fake.CheckInvoice(hashStr)
+	if !status.Paid || status.AmountPaidMsat != 5000 || status.Preimage != hex.EncodeToString(preimage) {
+		t.Errorf("got status %+v after paying", status)
+	}
+}
+
+func TestFakeSeeds(t *testing.T) {
+	a, _ := newTestFake("lnurlpayserver:shop-a").GetNodeId()
+	b, _ := newTestFake("lnurlpayserver:shop-b").GetNodeId()
+	if a == b {
+		t.Error("different seeds gave the same node")
+	}
+
+	defaults := backendKinds["fake"].Defaults
+	if defaults("shop-a")["seed"] == defaults("shop-b")["seed"] {
+		t.Error("different shops got the same default seed")
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// HTTPBackend talks to any custodial wallet API described in its connection:
+//
+//	{
+//	  "key": "secret token, available as {{key}}",
+//	  "create": {
+//	    "method": "POST",
+//	    "url": "https://wallet.example/api/invoices",
+//	    "headers": {"Authorization": "Bearer {{key}}"},
+//	    "body": "{\"msat\": {{msatoshi}}, \"description_hash\": \"{{description_hash}}\"}",
+//	    "bolt11": "data.payment_request"
+//	  },
+//	  "check": {
+//	    "url": "https://wallet.example/api/invoices/{{hash}}",
+//	    "headers": {"Authorization": "Bearer {{key}}"},
+//	    "paid": "data.status",
+//	    "paid_value": "settled",
+//	    "amount_msat": "data.received_msat",
+//	    "settled_at": "data.settled_at",
+//	    "preimage": "data.preimage"
+//	  }
+//	}
+//
+// url, headers and body are templates where {{name}} is replaced by the value
+// of that variable. Values are put in headers and body as they are, with no
+// escaping, and URL-escaped in the url. "bolt11", "paid",
+// "amount_msat", "settled_at" (unix seconds) and "preimage" (hex) are gjson
+// paths on the responses. When "paid_value" is not given the "paid" field is
+// read as a boolean. Only "paid" is required to check payments.
+type HTTPBackend struct {
+	conn gjson.Result
+	key  string
+}
+
+func init() {
+	RegisterBackendKind("http", BackendKind{
+		New: func(id string, conn gjson.Result) LightningBackend {
+			return &HTTPBackend{
+				conn: conn,
+				key:  conn.Get("key").String(),
+			}
+		},
+		Validate: func(conn gjson.Result) error {
+			err := requireStrings(conn,
+				[]string{"create.url", "create.bolt11", "check.url", "check.paid"},
+				[]string{"key", "create.method", "create.body",
+					"check.method", "check.body", "check.paid_value",
+					"check.amount_msat", "check.settled_at", "check.preimage"})
+			if err != nil {
+				return err
+			}
+			for _, call := range []string{"create", "check"} {
+				headers := conn.Get(call + ".headers")
+				if headers.Exists() && !headers.IsObject() {
+					return fmt.Errorf("connection.%s.headers must be an object", call)
+				}
+				for _, v := range headers.Map() {
+					if v.Type != gjson.String {
+						return fmt.Errorf("connection.%s.headers must have string values", call)
+					}
+				}
+			}
+			return nil
+		},
+		Secrets: []string{"key"},
+	})
+}
+
+var customHTTPClient = &http.Client{Timeout: time.Second * 15}
+
+type httpStatusError struct {
+	call   string
+	status int
+	body   string
+}
+
+func (e httpStatusError) Error() string {
+	return fmt.Sprintf("%s call returned %d: %s", e.call, e.status, e.body)
+}
+
+var httpTemplateVar = regexp.MustCompile(`\{\{\{?\s*(\w+)\s*\}?\}\}`)
+
+// renderHTTPTemplate replaces the variables in tpl, unknown ones are removed.
+func renderHTTPTemplate(tpl string, vars map[string]string, escape func(string) string) string {
+	return httpTemplateVar.ReplaceAllStringFunc(tpl, func(match string) string {
+		value := vars[httpTemplateVar.FindStringSubmatch(match)[1]]
+		if escape != nil {
+			return escape(value)
+		}
+		return value
+	})
+}
+
+// urlEscape escapes for both paths and query strings.
+func urlEscape(value string) string {
+	return strings.Replace(url.QueryEscape(value), "+", "%20", -1)
+}
+
+func (h *HTTPBackend) call(
+	ctx context.Context,
+	name string,
+	vars map[string]string,
+) (gjson.Result, error) {
+	spec := h.conn.Get(name)
+	vars["key"] = h.key
+
+	method := spec.Get("method").String()
+	if method == "" {
+		method = "GET"
+	}
+	var body *strings.Reader
+	if spec.Get("body").Exists() {
+		body = strings.NewReader(renderHTTPTemplate(spec.Get("body").String(), vars, nil))
+	} else {
+		body = strings.NewReader("")
+	}
+
+	req, err := http.NewRequestWithContext(ctx,
+		strings.ToUpper(method),
+		renderHTTPTemplate(spec.Get("url").String(), vars, urlEscape),
+		body,
+	)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	if spec.Get("body").Exists() {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range spec.Get("headers").Map() {
+		req.Header.Set(k, renderHTTPTemplate(v.String(), vars, nil))
+	}
+
+	resp, err := customHTTPClient.Do(req)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	if resp.StatusCode >= 300 {
+		if len(b) > 200 {
+			b = b[:200]
+		}
+		return gjson.Result{}, httpStatusError{name, resp.StatusCode, string(b)}
+	}
+
+	return gjson.ParseBytes(b), nil
+}
+
+func (h *HTTPBackend) MakeInvoice(
+	msatoshi int64,
+	description string,
+	preimage []byte,
+	expiry int,
+) (bolt11 string, err error) {
+	dh := sha256.Sum256([]byte(description))
+	hash := sha256.Sum256(preimage)
+
+	res, err := h.call(context.Background(), "create", map[string]string{
+		"msatoshi":                strconv.FormatInt(msatoshi, 10),
+		"sat":                     strconv.FormatInt(msatoshi/1000, 10),
+		"description_hex":         hex.EncodeToString([]byte(description)),
+		"description_hash":        hex.EncodeToString(dh[:]),
+		"description_hash_base64": base64.StdEncoding.EncodeToString(dh[:]),
+		"preimage":                hex.EncodeToString(preimage),
+		"preimage_base64":         base64.StdEncoding.EncodeToString(preimage),
+		"hash":                    hex.EncodeToString(hash[:]),
+		"expiry":                  strconv.Itoa(expiry),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	bolt11 = res.Get(h.conn.Get("create.bolt11").String()).String()
+	if bolt11 == "" {
+		return "", errors.New("no invoice found in the create response")
+	}
+	return bolt11, nil
+}
+
+func (h *HTTPBackend) check(ctx context.Context, hash string) (InvoiceStatus, error) {
+	res, err := h.call(ctx, "check", map[string]string{"hash": hash})
+	if err != nil {
+		return InvoiceStatus{}, err
+	}
+
+	var paid bool
+	field := res.Get(h.conn.Get("check.paid").String())
+	if expected := h.conn.Get("check.paid_value"); expected.Exists() {
+		paid = field.String() == expected.String()
+	} else {
+		paid = field.Bool()
+	}
+	if !paid {
+		return InvoiceStatus{}, nil
+	}
+
+	status := InvoiceStatus{Paid: true}
+	if path := h.conn.Get("check.amount_msat"); path.Exists() {
+		status.AmountPaidMsat = parseMsat(res.Get(path.String()))
+	}
+	if path := h.conn.Get("check.settled_at"); path.Exists() {
+		status.SettledAt = unixTime(res.Get(path.String()))
+	}
+	if path := h.conn.Get("check.preimage"); path.Exists() {
+		status.Preimage = res.Get(path.String()).String()
+	}
+	return status, nil
+}
+
+func (h *HTTPBackend) CheckInvoice(hash string) (InvoiceStatus, error) {
+	return h.check(context.Background(), hash)
+}
+
+func (h *HTTPBackend) WaitInvoice(ctx context.Context, hash string) (InvoiceStatus, error) {
+	return pollInvoice(ctx, func(ctx context.Context) (InvoiceStatus, error) {
+		return h.check(ctx, hash)
+	})
+}
+
+// Healthcheck can only check an invoice that doesn't exist, so it only
+// fails when the server can't be reached or has an internal error.
+func (h *HTTPBackend) Healthcheck(ctx context.Context) error {
+	_, err := h.check(ctx, strings.Repeat("0", 64))
+	var serr httpStatusError
+	if errors.As(err, &serr) && serr.status < 500 {
+		return nil
+	}
+	return err
+}
+
+func (h *HTTPBackend) GetNodeId() (string, error) {
+	return custodialWalletId(h, h.conn.Get("create.url").String(), h.key)
+}
@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestRenderHTTPTemplate(t *testing.T) {
+	vars := map[string]string{
+		"key":  `a&b"c'd<e>f`,
+		"hash": "ab+/=",
+	}
+
+	for _, c := range []struct {
+		tpl      string
+		escape   func(string) string
+		expected string
+	}{
+		{"Bearer {{key}}", nil, `Bearer a&b"c'd<e>f`},
+		{"Bearer {{ key }}", nil, `Bearer a&b"c'd<e>f`},
+		{"Bearer {{{key}}}", nil, `Bearer a&b"c'd<e>f`},
+		{`{"hash": "{{hash}}", "x": "{{missing}}"}`, nil, `{"hash": "ab+/=", "x": ""}`},
+		{"https://w.example/i/{{hash}}?k={{key}}", urlEscape,
+			"https://w.example/i/ab%2B%2F%3D?k=a%26b%22c%27d%3Ce%3Ef"},
+	} {
+		if got := renderHTTPTemplate(c.tpl, vars, c.escape); got != c.expected {
+			t.Errorf("%q rendered as %q, expected %q", c.tpl, got, c.expected)
+		}
+	}
+
+	if got := urlEscape("a b"); got != "a%20b" {
+		t.Errorf("space escaped as %q", got)
+	}
+}
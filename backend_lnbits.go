@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+func init() {
+	RegisterBackendKind("lnbits", BackendKind{
+		New: func(id string, conn gjson.Result) LightningBackend {
+			return &LNbitsBackend{
+				url: strings.TrimSuffix(conn.Get("url").String(), "/"),
+				key: conn.Get("key").String(),
+			}
+		},
+		Validate: func(conn gjson.Result) error {
+			return requireStrings(conn, []string{"url", "key"}, nil)
+		},
+		Secrets: []string{"key"},
+	})
+}
+
+// LNbitsBackend uses an LNbits wallet through its invoice/read key. LNbits
+// always generates its own preimages, so the ones we send are ignored.
+type LNbitsBackend struct {
+	url string
+	key string
+}
+
+var lnbitsClient = &http.Client{Timeout: time.Second * 15}
+
+func (lnbits *LNbitsBackend) call(
+	ctx context.Context,
+	method string,
+	path string,
+	body string,
+) (gjson.Result, error) {
+	req, err := http.NewRequestWithContext(ctx, method, lnbits.url+path,
+		bytes.NewBufferString(body))
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	req.Header.Set("X-Api-Key", lnbits.key)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := lnbitsClient.Do(req)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+
+	res := gjson.ParseBytes(b)
+	if resp.StatusCode >= 300 {
+		return res, fmt.Errorf("call to lnbits failed (%d): %s",
+			resp.StatusCode, res.Get("detail").String())
+	}
+	return res, nil
+}
+
+func (lnbits *LNbitsBackend) MakeInvoice(
+	msatoshi int64,
+	description string,
+	preimage []byte,
+	expiry int,
+) (bolt11 string, err error) {
+	body, _ := sjson.Set("{}", "out", false)
+	body, _ = sjson.Set(body, "amount", msatoshi/1000)
+	body, _ = sjson.Set(body, "memo", "")
+	body, _ = sjson.Set(body, "expiry", expiry)
+	if description != "" {
+		// lnbits will put the hash of this in the invoice
+		body, _ = sjson.Set(body, "unhashed_description",
+			hex.EncodeToString([]byte(description)))
+	} else {
+		h := sha256.Sum256([]byte(description))
+		body, _ = sjson.Set(body, "description_hash", hex.EncodeToString(h[:]))
+	}
+
+	inv, err := lnbits.call(context.Background(), "POST", "/api/v1/payments", body)
+	if err != nil {
+		return "", err
+	}
+
+	return inv.Get("payment_request").String(), nil
+}
+
+func (lnbits *LNbitsBackend) CheckInvoice(hash string) (InvoiceStatus, error) {
+	return lnbits.check(context.Background(), hash)
+}
+
+func (lnbits *LNbitsBackend) check(ctx context.Context, hash string) (InvoiceStatus, error) {
+	payment, err := lnbits.call(ctx, "GET", "/api/v1/payments/"+hash, "")
+	if err != nil {
+		return InvoiceStatus{}, err
+	}
+	if !payment.Get("paid").Bool() {
+		return InvoiceStatus{}, nil
+	}
+	return InvoiceStatus{
+		Paid:           true,
+		AmountPaidMsat: payment.Get("details.amount").Int(),
+		SettledAt:      unixTime(payment.Get("details.time")),
+		Preimage:       payment.Get("preimage").String(),
+	}, nil
+}
+
+func (lnbits *LNbitsBackend) WaitInvoice(ctx context.Context, hash string) (InvoiceStatus, error) {
+	// lnbits has no way to wait on a single invoice
+	return pollInvoice(ctx, func(ctx context.Context) (InvoiceStatus, error) {
+		return lnbits.check(ctx, hash)
+	})
+}
+
+func (lnbits *LNbitsBackend) Healthcheck(ctx context.Context) error {
+	_, err := lnbits.call(ctx, "GET", "/api/v1/wallet", "")
+	return err
+}
+
+func (lnbits *LNbitsBackend) GetNodeId() (string, error) {
+	return custodialWalletId(lnbits, lnbits.url, lnbits.key)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+const (
+	lnbitsTestKey      = "invoicekey"
+	lnbitsTestPaid     = "aaaa"
+	lnbitsTestUnpaid   = "bbbb"
+	lnbitsTestPreimage = "0101010101010101010101010101010101010101010101010101010101010101"
+)
+
+// lnbitsStandIn serves the parts of the LNbits API we use. Requests made to
+// create invoices are sent to the returned channel.
+func lnbitsStandIn(t *testing.T) (*httptest.Server, chan gjson.Result) {
+	created := make(chan gjson.Result, 1)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/payments", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(405)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		created <- gjson.ParseBytes(body)
+
+		w.WriteHeader(201)
+		json.NewEncoder(w).Encode(map[string]string{
+			"payment_hash":    lnbitsTestPaid,
+			"payment_request": "lnbc1standin",
+		})
+	})
+	mux.HandleFunc("/api/v1/payments/", func(w http.ResponseWriter, r *http.Request) {
+		switch strings.TrimPrefix(r.URL.Path, "/api/v1/payments/") {
+		case lnbitsTestPaid:
+			w.Write([]byte(`{"paid": true, "preimage": "` + lnbitsTestPreimage + `",
+              "details": {"amount": 21000, "time": 1600000000}}`))
+		case lnbitsTestUnpaid:
+			w.Write([]byte(`{"paid": false, "preimage": null, "details": {"amount": 21000}}`))
+		default:
+			w.WriteHeader(404)
+			w.Write([]byte(`{"detail": "Payment does not exist."}`))
+		}
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Api-Key") != lnbitsTestKey {
+			w.WriteHeader(401)
+			w.Write([]byte(`{"detail": "Invalid key"}`))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, created
+}
+
+func newTestLNbits(url string, key string) LightningBackend {
+	conn, _ := json.Marshal(map[string]string{"url": url + "/", "key": key})
+	return backendKinds["lnbits"].New("test", gjson.ParseBytes(conn))
+}
+
+func TestLNbitsMakeInvoice(t *testing.T) {
+	server, created := lnbitsStandIn(t)
+	ln := newTestLNbits(server.URL, lnbitsTestKey)
+
+	bolt11, err := ln.MakeInvoice(21500, `[["text/plain","cookie"]]`, nil, 600)
+	if err != nil {
+		t.Fatalf("MakeInvoice failed: %s", err)
+	}
+	if bolt11 != "lnbc1standin" {
+		t.Errorf("got bolt11 %q", bolt11)
+	}
+
+	req := <-created
+	if req.Get("out").Bool() {
+		t.Error("invoice was requested as outgoing")
+	}
+	if amount := req.Get("amount").Int(); amount != 21 {
+		t.Errorf("requested %d sat, expected 21", amount)
+	}
+	if expiry := req.Get("expiry").Int(); expiry != 600 {
+		t.Errorf("requested expiry %d, expected 600", expiry)
+	}
+	description, _ := hex.DecodeString(req.Get("unhashed_description").String())
+	if string(description) != `[["text/plain","cookie"]]` {
+		t.Errorf("requested description %q", description)
+	}
+}
+
+func TestLNbitsCheckInvoice(t *testing.T) {
+	server, _ := lnbitsStandIn(t)
+	ln := newTestLNbits(server.URL, lnbitsTestKey)
+
+	status, err := ln.CheckInvoice(lnbitsTestPaid)
+	if err != nil {
+		t.Fatalf("CheckInvoice failed: %s", err)
+	}
+	if !status.Paid {
+		t.Fatal("paid invoice reported as unpaid")
+	}
+	if status.AmountPaidMsat != 21000 {
+		t.Errorf("got amount paid %d, expected 21000", status.AmountPaidMsat)
+	}
+	if !status.SettledAt.Equal(time.Unix(1600000000, 0)) {
+		t.Errorf("got settled at %s", status.SettledAt)
+	}
+	if status.Preimage != lnbitsTestPreimage {
+		t.Errorf("got preimage %q", status.Preimage)
+	}
+
+	status, err = ln.CheckInvoice(lnbitsTestUnpaid)
+	if err != nil {
+		t.Fatalf("CheckInvoice failed: %s", err)
+	}
+	if status != (InvoiceStatus{}) {
+		t.Errorf("unpaid invoice reported as %+v", status)
+	}
+}
+
+func TestLNbitsErrors(t *testing.T) {
+	server, _ := lnbitsStandIn(t)
+
+	ln := newTestLNbits(server.URL, lnbitsTestKey)
+	_, err := ln.CheckInvoice("cccc")
+	if err == nil || !strings.Contains(err.Error(), "Payment does not exist") {
+		t.Errorf("expected not found error, got %v", err)
+	}
+
+	wrong := newTestLNbits(server.URL, "wrong")
+	if _, err := wrong.MakeInvoice(1000, "", nil, 600); err == nil ||
+		!strings.Contains(err.Error(), "401") {
+		t.Errorf("expected 401 making invoice with the wrong key, got %v", err)
+	}
+	if _, err := wrong.CheckInvoice(lnbitsTestPaid); err == nil {
+		t.Error("expected error checking invoice with the wrong key")
+	}
+
+	down := newTestLNbits("http://127.0.0.1:1", lnbitsTestKey)
+	if _, err := down.MakeInvoice(1000, "", nil, 600); err == nil {
+		t.Error("expected error when lnbits is unreachable")
+	}
+}
+
+func TestLNbitsValidate(t *testing.T) {
+	validate := backendKinds["lnbits"].Validate
+
+	for _, conn := range []string{
+		`{"url": "https://lnbits.example"}`,
+		`{"url": "https://lnbits.example", "key": 123}`,
+		`{"url": "https://lnbits.example", "key": ["invoicekey"]}`,
+		`{"key": "invoicekey"}`,
+	} {
+		if err := validate(gjson.Parse(conn)); err == nil {
+			t.Errorf("%s should be invalid", conn)
+		}
+	}
+
+	if err := validate(gjson.Parse(`{"url": "https://lnbits.example", "key": "invoicekey"}`)); err != nil {
+		t.Errorf("valid connection rejected: %s", err)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	cmap "github.com/orcaman/concurrent-map"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+func init() {
+	RegisterBackendKind("lnd", BackendKind{
+		New: func(id string, conn gjson.Result) LightningBackend {
+			return &LNDBackend{
+				endpoint: conn.Get("endpoint").String(),
+				macaroon: conn.Get("macaroon").String(),
+				client:   httpClientFor(id, conn.Get("cert").String()),
+			}
+		},
+		Validate: func(conn gjson.Result) error {
+			return requireStrings(conn, []string{"endpoint", "macaroon"}, []string{"cert"})
+		},
+		Secrets: []string{"macaroon"},
+	})
+}
+
+type LNDBackend struct {
+	endpoint string
+	macaroon string
+	client   *http.Client
+}
+
+func (lnd *LNDBackend) get(ctx context.Context, path string) (gjson.Result, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", lnd.endpoint+path, nil)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	req.Header.Set("Grpc-Metadata-macaroon", lnd.macaroon)
+	resp, err := lnd.client.Do(req)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return gjson.Result{}, errors.New("call to lnd failed")
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	return gjson.ParseBytes(b), nil
+}
+
+func (lnd *LNDBackend) post(path string, body string) (gjson.Result, error) {
+	req, err := http.NewRequest("POST", lnd.endpoint+path,
+		bytes.NewBufferString(body))
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	req.Header.Set("Grpc-Metadata-macaroon", lnd.macaroon)
+	resp, err := lnd.client.Do(req)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	res := gjson.ParseBytes(b)
+	if resp.StatusCode >= 300 {
+		return res, errors.New("call to lnd failed: " + res.Get("message").String())
+	}
+	return res, nil
+}
+
+func (lnd *LNDBackend) MakeInvoice(
+	msatoshi int64,
+	description string,
+	preimage []byte,
+	expiry int,
+) (bolt11 string, err error) {
+	h := sha256.Sum256([]byte(description))
+	body, _ := sjson.Set("{}", "description_hash", base64.StdEncoding.EncodeToString(h[:]))
+	body, _ = sjson.Set(body, "value", msatoshi/1000)
+	body, _ = sjson.Set(body, "preimage", base64.StdEncoding.EncodeToString(preimage))
+	body, _ = sjson.Set(body, "expiry", strconv.Itoa(expiry))
+
+	req, err := http.NewRequest("POST",
+		lnd.endpoint+"/v1/invoices",
+		bytes.NewBufferString(body),
+	)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Grpc-Metadata-macaroon", lnd.macaroon)
+	resp, err := lnd.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return "", errors.New("call to lnd failed")
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	return gjson.ParseBytes(b).Get("payment_request").String(), nil
+}
+
+func lndInvoiceStatus(invdata gjson.Result) InvoiceStatus {
+	if !invdata.Get("settled").Bool() {
+		return InvoiceStatus{}
+	}
+	preimage, _ := base64.StdEncoding.DecodeString(invdata.Get("r_preimage").String())
+	return InvoiceStatus{
+		Paid:           true,
+		AmountPaidMsat: invdata.Get("amt_paid_msat").Int(),
+		SettledAt:      unixTime(invdata.Get("settle_date")),
+		Preimage:       hex.EncodeToString(preimage),
+	}
+}
+
+func (lnd *LNDBackend) CheckInvoice(hash string) (InvoiceStatus, error) {
+	invdata, err := lnd.get(context.Background(), "/v1/invoice/"+hash)
+	if err != nil {
+		return InvoiceStatus{}, err
+	}
+	return lndInvoiceStatus(invdata), nil
+}
+
+func (lnd *LNDBackend) WaitInvoice(ctx context.Context, hash string) (InvoiceStatus, error) {
+	sub := subscriptionFor("lnd:"+lnd.endpoint, lnd.listen)
+	wake, done := sub.wait(hash)
+	defer done()
+
+	for {
+		invdata, err := lnd.get(ctx, "/v1/invoice/"+hash)
+		if err != nil {
+			if ctx.Err() != nil {
+				return InvoiceStatus{}, nil
+			}
+			return InvoiceStatus{}, err
+		}
+		if invdata.Get("settled").Bool() {
+			return lndInvoiceStatus(invdata), nil
+		}
+		if invdata.Get("state").String() == "CANCELED" {
+			// expired or canceled
+			return InvoiceStatus{}, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return InvoiceStatus{}, nil
+		case <-wake:
+		}
+	}
+}
+
+// last settle_index seen for each node, so we can resume after a disconnect
+var lndSettleIndexes = cmap.New()
+
+// listen reads lnd's invoice stream, a single one for all invoices on a node.
+func (lnd *LNDBackend) listen(ctx context.Context, sub *invoiceSubscription) error {
+	var settleIndex uint64
+	if v, ok := lndSettleIndexes.Get(lnd.endpoint); ok {
+		settleIndex = v.(uint64)
+	}
+
+	path := "/v1/invoices/subscribe"
+	if settleIndex > 0 {
+		// lnd will first replay everything settled after this
+		path += "?settle_index=" + strconv.FormatUint(settleIndex, 10)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", lnd.endpoint+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Grpc-Metadata-macaroon", lnd.macaroon)
+	resp, err := lnd.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.New("error on lnd invoices/subscribe")
+	}
+
+	if settleIndex == 0 {
+		// we don't know what we may have missed, so everybody checks again
+		sub.resync()
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event struct {
+			Result struct {
+				RHash       []byte `json:"r_hash"`
+				Settled     bool   `json:"settled"`
+				SettleIndex uint64 `json:"settle_index,string"`
+			} `json:"result"`
+		}
+		err := decoder.Decode(&event)
+		if err != nil {
+			return err
+		}
+
+		if !event.Result.Settled {
+			continue
+		}
+
+		if event.Result.SettleIndex > settleIndex {
+			settleIndex = event.Result.SettleIndex
+			lndSettleIndexes.Set(lnd.endpoint, settleIndex)
+		}
+		sub.notify(hex.EncodeToString(event.Result.RHash))
+	}
+}
+
+func (lnd *LNDBackend) MakeHoldInvoice(
+	msatoshi int64,
+	description string,
+	preimage []byte,
+	expiry int,
+) (bolt11 string, err error) {
+	h := sha256.Sum256([]byte(description))
+	hash := sha256.Sum256(preimage)
+
+	body, _ := sjson.Set("{}", "hash", base64.StdEncoding.EncodeToString(hash[:]))
+	body, _ = sjson.Set(body, "description_hash", base64.StdEncoding.EncodeToString(h[:]))
+	body, _ = sjson.Set(body, "value_msat", strconv.FormatInt(msatoshi, 10))
+	body, _ = sjson.Set(body, "expiry", strconv.Itoa(expiry))
+
+	res, err := lnd.post("/v2/invoices/hodl", body)
+	if err != nil {
+		return "", err
+	}
+	return res.Get("payment_request").String(), nil
+}
+
+func (lnd *LNDBackend) HoldInvoiceState(hash string) (string, error) {
+	invdata, err := lnd.get(context.Background(), "/v1/invoice/"+hash)
+	if err != nil {
+		return "", err
+	}
+	// lnd uses OPEN, ACCEPTED, SETTLED and CANCELED
+	return strings.ToLower(invdata.Get("state").String()), nil
+}
+
+func (lnd *LNDBackend) SettleHoldInvoice(preimage []byte) error {
+	body, _ := sjson.Set("{}", "preimage", base64.StdEncoding.EncodeToString(preimage))
+	_, err := lnd.post("/v2/invoices/settle", body)
+	return err
+}
+
+func (lnd *LNDBackend) CancelHoldInvoice(hash string) error {
+	bhash, err := hex.DecodeString(hash)
+	if err != nil {
+		return err
+	}
+	body, _ := sjson.Set("{}", "payment_hash", base64.StdEncoding.EncodeToString(bhash))
+	_, err = lnd.post("/v2/invoices/cancel", body)
+	return err
+}
+
+func (lnd *LNDBackend) Healthcheck(ctx context.Context) error {
+	_, err := lnd.get(ctx, "/v1/getinfo")
+	return err
+}
+
+func (lnd *LNDBackend) GetNodeId() (string, error) {
+	return nodeIdFromInvoice(lnd)
+}
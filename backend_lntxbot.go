@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+func init() {
+	RegisterBackendKind("lntxbot", BackendKind{
+		New: func(id string, conn gjson.Result) LightningBackend {
+			endpoint := conn.Get("endpoint").String()
+			if endpoint == "" {
+				endpoint = "https://lntxbot.bigsun.xyz"
+			}
+
+			return &LntxbotBackend{
+				endpoint: strings.TrimSuffix(endpoint, "/"),
+				key:      conn.Get("key").String(),
+			}
+		},
+		Validate: func(conn gjson.Result) error {
+			return requireStrings(conn, []string{"key"}, []string{"endpoint"})
+		},
+		Secrets: []string{"key"},
+	})
+}
+
+type LntxbotBackend struct {
+	endpoint string
+	key      string
+}
+
+func (lntxbot *LntxbotBackend) MakeInvoice(
+	msatoshi int64,
+	description string,
+	preimage []byte,
+	expiry int,
+) (bolt11 string, err error) {
+	h := sha256.Sum256([]byte(description))
+	body, _ := sjson.Set("{}", "description_hash", hex.EncodeToString(h[:]))
+	body, _ = sjson.Set(body, "amt", strconv.FormatInt(msatoshi/1000, 10))
+	body, _ = sjson.Set(body, "preimage", hex.EncodeToString(preimage))
+
+	req, err := http.NewRequest("POST",
+		lntxbot.endpoint+"/addinvoice",
+		bytes.NewBufferString(body),
+	)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", lntxbot.key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	inv := gjson.ParseBytes(b)
+	if inv.Get("error").Bool() {
+		return "", fmt.Errorf("Call to lntxbot failed: %s",
+			inv.Get("message").String())
+	}
+
+	return inv.Get("pay_req").String(), nil
+}
+
+func (lntxbot *LntxbotBackend) invoiceStatus(
+	ctx context.Context,
+	hash string,
+	wait bool,
+) (InvoiceStatus, error) {
+	url := lntxbot.endpoint + "/invoicestatus/" + hash
+	if !wait {
+		url += "?wait=false"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return InvoiceStatus{}, err
+	}
+	req.Header.Set("Authorization", lntxbot.key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return InvoiceStatus{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return InvoiceStatus{}, errors.New("call to lntxbot failed")
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return InvoiceStatus{}, err
+	}
+
+	inv := gjson.ParseBytes(b)
+	if inv.Get("error").Bool() {
+		return InvoiceStatus{}, fmt.Errorf("error on lntxbot invoicestatus: %s",
+			inv.Get("message").String())
+	}
+
+	// lntxbot only tells us the preimage
+	preimage := inv.Get("preimage").String()
+	return InvoiceStatus{Paid: preimage != "", Preimage: preimage}, nil
+}
+
+func (lntxbot *LntxbotBackend) CheckInvoice(hash string) (InvoiceStatus, error) {
+	return lntxbot.invoiceStatus(context.Background(), hash, false)
+}
+
+func (lntxbot *LntxbotBackend) WaitInvoice(ctx context.Context, hash string) (InvoiceStatus, error) {
+	return lntxbot.invoiceStatus(ctx, hash, true)
+}
+
+func (lntxbot *LntxbotBackend) Healthcheck(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET",
+		lntxbot.endpoint+"/balance", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", lntxbot.key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("lntxbot balance returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (lntxbot *LntxbotBackend) GetNodeId() (string, error) {
+	return custodialWalletId(lntxbot, lntxbot.endpoint, lntxbot.key)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	lightning "github.com/fiatjaf/lightningd-gjson-rpc"
+	"github.com/tidwall/gjson"
+)
+
+func init() {
+	RegisterBackendKind("spark", BackendKind{
+		New: func(id string, conn gjson.Result) LightningBackend {
+			return &SparkBackend{
+				endpoint: conn.Get("endpoint").String(),
+				key:      conn.Get("key").String(),
+				hasCert:  conn.Get("cert").Exists(),
+			}
+		},
+		Validate: func(conn gjson.Result) error {
+			return requireStrings(conn, []string{"endpoint", "key"}, []string{"cert"})
+		},
+		Secrets: []string{"key"},
+	})
+}
+
+type SparkBackend struct {
+	endpoint string
+	key      string
+	hasCert  bool
+}
+
+func (spark *SparkBackend) client(timeout time.Duration) *lightning.Client {
+	return &lightning.Client{
+		SparkURL:              spark.endpoint,
+		SparkToken:            spark.key,
+		CallTimeout:           timeout,
+		DontCheckCertificates: !spark.hasCert, /* don't check if not */
+	}
+}
+
+func (spark *SparkBackend) MakeInvoice(
+	msatoshi int64,
+	description string,
+	preimage []byte,
+	expiry int,
+) (bolt11 string, err error) {
+	h := sha256.Sum256([]byte(description))
+	hash := sha256.Sum256(preimage)
+	inv, err := spark.client(time.Second*3).CallNamed("lnurlinvoice",
+		"msatoshi", msatoshi,
+		"label", "lnurlpayserver/"+hex.EncodeToString(hash[:])[:5],
+		"description_hash", hex.EncodeToString(h[:]),
+		"expiry", expiry,
+		"preimage", hex.EncodeToString(preimage),
+	)
+	if err != nil {
+		return "", fmt.Errorf("lnurlinvoice call failed: %w", err)
+	}
+	return inv.Get("bolt11").String(), nil
+}
+
+func (spark *SparkBackend) CheckInvoice(hash string) (InvoiceStatus, error) {
+	inv, err := spark.client(time.Second*10).Call("waitinvoice", "lnurlpayserver/"+hash[:5])
+	if err != nil {
+		return InvoiceStatus{}, err
+	}
+	return clnInvoiceStatus(inv), nil
+}
+
+func (spark *SparkBackend) WaitInvoice(ctx context.Context, hash string) (InvoiceStatus, error) {
+	inv, err := spark.client(time.Minute*15).Call("waitinvoice", "lnurlpayserver/"+hash[:5])
+	if err != nil {
+		return InvoiceStatus{}, fmt.Errorf("error on spark waitinvoice: %w", err)
+	}
+	return clnInvoiceStatus(inv), nil
+}
+
+func (spark *SparkBackend) Healthcheck(ctx context.Context) error {
+	_, err := spark.client(time.Second*10).Call("listinvoices",
+		"lnurlpayserver/healthcheck")
+	return err
+}
+
+func (spark *SparkBackend) GetNodeId() (string, error) {
+	return nodeIdFromInvoice(spark)
+}
@@ -1,39 +1,126 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
-	"crypto/tls"
-	"crypto/x509"
-	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
-	lightning "github.com/fiatjaf/lightningd-gjson-rpc"
 	decodepay "github.com/fiatjaf/ln-decodepay"
 	"github.com/jmoiron/sqlx/types"
 	"github.com/tidwall/gjson"
 	"github.com/tidwall/sjson"
 )
 
-func BackendFromShop(shopId string) (*Backend, error) {
-	var backend Backend
-	err = pg.Get(&backend, `
+// LightningBackend is what each kind of node or wallet must implement
+// in order to be used by a shop.
+type LightningBackend interface {
+	// MakeInvoice must commit to the sha256 of the given description in the
+	// invoice's description_hash and use the given preimage.
+	MakeInvoice(msatoshi int64, description string, preimage []byte, expiry int) (bolt11 string, err error)
+
+	// CheckInvoice returns immediately with the current payment status.
+	CheckInvoice(hash string) (InvoiceStatus, error)
+
+	// WaitInvoice blocks until the invoice is paid, the context is done or
+	// something fails. A non-paid result with no error means it won't be paid.
+	WaitInvoice(ctx context.Context, hash string) (InvoiceStatus, error)
+
+	GetNodeId() (string, error)
+
+	// Healthcheck does the cheapest call that tells us the backend is working.
+	Healthcheck(ctx context.Context) error
+}
+
+// InvoiceStatus is what the backend tells us about a payment. The details are
+// left empty when the backend doesn't report them.
+type InvoiceStatus struct {
+	Paid           bool
+	AmountPaidMsat int64
+	SettledAt      time.Time
+	Preimage       string // hex
+}
+
+// HoldInvoiceBackend is implemented by backends that can make invoices that
+// are only settled when we decide to, after the payment has arrived.
+type HoldInvoiceBackend interface {
+	MakeHoldInvoice(msatoshi int64, description string, preimage []byte, expiry int) (bolt11 string, err error)
+
+	// HoldInvoiceState returns one of the HOLD_* states.
+	HoldInvoiceState(hash string) (string, error)
+
+	SettleHoldInvoice(preimage []byte) error
+	CancelHoldInvoice(hash string) error
+}
+
+const (
+	HOLD_OPEN     = "open"
+	HOLD_ACCEPTED = "accepted"
+	HOLD_SETTLED  = "settled"
+	HOLD_CANCELED = "canceled"
+)
+
+type BackendKind struct {
+	New      func(id string, conn gjson.Result) LightningBackend
+	Validate func(conn gjson.Result) error
+
+	// connection fields that are encrypted at rest and never logged
+	Secrets []string
+
+	// Defaults gives connection fields to use when they're missing, if set.
+	Defaults func(shopId string) map[string]string
+
+	// Enabled tells if backends of this kind can be used, nil means always.
+	Enabled func() bool
+}
+
+func (bk BackendKind) enabled() bool {
+	return bk.Enabled == nil || bk.Enabled()
+}
+
+var backendKinds = make(map[string]BackendKind)
+
+// RegisterBackendKind makes a backend kind available to shops. It should be
+// called from an init() function in the file that implements the kind.
+func RegisterBackendKind(kind string, bk BackendKind) {
+	if _, exists := backendKinds[kind]; exists {
+		panic("backend kind " + kind + " registered twice")
+	}
+	backendKinds[kind] = bk
+}
+
+func BackendsFromShop(shopId string) ([]Backend, error) {
+	var backends []Backend
+	err := pg.Select(&backends, `
       SELECT backend.* FROM backend
-      INNER JOIN shop ON shop.backend = backend.id
-      WHERE shop.id = $1
+      INNER JOIN shop_backend ON shop_backend.backend = backend.id
+      WHERE shop_backend.shop = $1
+      ORDER BY shop_backend.position
     `, shopId)
 	if err != nil {
 		return nil, err
 	}
+	if len(backends) == 0 {
+		return nil, errors.New("shop has no backends")
+	}
+
+	return backends, nil
+}
+
+func BackendById(id string) (*Backend, error) {
+	var backend Backend
+	err := pg.Get(&backend, `
+      SELECT * FROM backend WHERE id = $1
+    `, id)
+	if err != nil {
+		return nil, err
+	}
 
 	return &backend, nil
 }
@@ -44,377 +131,273 @@ type Backend struct {
 	Connection types.JSONText `db:"connection" json:"connection"`
 }
 
-func (b Backend) Conn() gjson.Result {
-	return gjson.ParseBytes(b.Connection)
+// Conn returns the connection with all secrets decrypted. It fails instead of
+// returning the sealed values when they can't be decrypted, as happens with
+// the wrong CONNECTION_SECRET.
+func (b Backend) Conn() (gjson.Result, error) {
+	conn, err := mapSecrets(b.Kind, b.Connection, openSecret)
+	if err != nil {
+		log.Error().Err(err).Str("backend", b.Id).
+			Msg("failed to decrypt backend connection")
+		return gjson.Result{}, fmt.Errorf("failed to decrypt backend connection: %w", err)
+	}
+	return gjson.Parse(conn), nil
+}
+
+// SealedConnection returns the connection as it should be stored.
+func (b Backend) SealedConnection() (string, error) {
+	return mapSecrets(b.Kind, b.Connection, func(value string) (string, error) {
+		resealed, _, err := resealSecret(value)
+		return resealed, err
+	})
+}
+
+// Redacted returns the connection without secrets, for logging.
+func (b Backend) Redacted() string {
+	conn, _ := mapSecrets(b.Kind, b.Connection, func(string) (string, error) {
+		return "[redacted]", nil
+	})
+	return conn
+}
+
+func (b Backend) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Id         string          `json:"id"`
+		Kind       string          `json:"kind"`
+		Connection json.RawMessage `json:"connection"`
+	}{b.Id, b.Kind, json.RawMessage(b.Redacted())})
+}
+
+// applyDefaults fills the connection fields the shop didn't give.
+func (b *Backend) applyDefaults(shopId string) {
+	bk, ok := backendKinds[b.Kind]
+	if !ok || bk.Defaults == nil {
+		return
+	}
+	for key, value := range bk.Defaults(shopId) {
+		if !gjson.GetBytes(b.Connection, key).Exists() {
+			b.Connection, _ = sjson.SetBytes(b.Connection, key, value)
+		}
+	}
+}
+
+func (b Backend) Validate() error {
+	bk, ok := backendKinds[b.Kind]
+	if !ok {
+		return errors.New("unsupported lightning server kind: " + b.Kind)
+	}
+	if !bk.enabled() {
+		return errors.New(b.Kind + " backends are disabled on this server")
+	}
+
+	conn, err := b.Conn()
+	if err != nil {
+		return err
+	}
+	if !conn.IsObject() {
+		return errors.New("connection must be an object")
+	}
+
+	return bk.Validate(conn)
+}
+
+func (b Backend) lightning() (LightningBackend, error) {
+	bk, ok := backendKinds[b.Kind]
+	if !ok {
+		return nil, errors.New("unsupported lightning server kind: " + b.Kind)
+	}
+	if !bk.enabled() {
+		return nil, errors.New(b.Kind + " backends are disabled on this server")
+	}
+	conn, err := b.Conn()
+	if err != nil {
+		return nil, err
+	}
+	return bk.New(b.Id, conn), nil
+}
+
+func (b Backend) holdInvoices() (HoldInvoiceBackend, error) {
+	ln, err := b.lightning()
+	if err != nil {
+		return nil, err
+	}
+	hold, ok := ln.(HoldInvoiceBackend)
+	if !ok {
+		return nil, errors.New(b.Kind + " backends don't support hold invoices")
+	}
+	return hold, nil
 }
 
 func (b *Backend) GetId() error {
-	useless := make([]byte, 32)
-	rand.Read(useless)
-	nothing := sha256.Sum256([]byte{0})
-	bolt11, err := b.MakeInvoice(1000, nothing, useless, 600)
+	ln, err := b.lightning()
 	if err != nil {
 		return err
 	}
 
-	inv, err := decodepay.Decodepay(bolt11)
+	id, err := ln.GetNodeId()
 	if err != nil {
 		return err
 	}
 
-	b.Id = inv.Payee
+	b.Id = id
 	return nil
 }
 
-func (b Backend) MakeInvoice(msatoshi int64, h [32]byte, preimage []byte, expiry int) (bolt11 string, err error) {
-	conn := b.Conn()
-	log.Debug().Interface("conn", conn.String()).Int64("msatoshi", msatoshi).
-		Msg("making invoice")
+// nodeIdFromInvoice makes a throwaway invoice and reads the payee from it,
+// which works for every backend that can make invoices.
+func nodeIdFromInvoice(ln LightningBackend) (string, error) {
+	useless := make([]byte, 32)
+	rand.Read(useless)
+	bolt11, err := ln.MakeInvoice(1000, "", useless, 600)
+	if err != nil {
+		return "", err
+	}
 
-	hexh := hex.EncodeToString(h[:])
-	b64h := base64.StdEncoding.EncodeToString(h[:])
+	inv, err := decodepay.Decodepay(bolt11)
+	if err != nil {
+		return "", err
+	}
 
-	switch b.Kind {
-	case "spark":
-		spark := &lightning.Client{
-			SparkURL:              conn.Get("endpoint").String(),
-			SparkToken:            conn.Get("key").String(),
-			CallTimeout:           time.Second * 3,
-			DontCheckCertificates: !conn.Get("cert").Exists(), /* don't check if not */
-		}
-		hash := sha256.Sum256(preimage)
-		inv, err := spark.CallNamed("lnurlinvoice",
-			"msatoshi", msatoshi,
-			"label", "lnurlpayserver/"+hex.EncodeToString(hash[:])[:5],
-			"description_hash", hexh,
-			"expiry", expiry,
-			"preimage", hex.EncodeToString(preimage),
-		)
-		if err != nil {
-			return "", fmt.Errorf("lnurlinvoice call failed: %w", err)
-		}
-		return inv.Get("bolt11").String(), nil
-
-	case "lnd":
-		// don't check certificates when not provided
-		defer func(prevTransport http.RoundTripper) {
-			http.DefaultClient.Transport = prevTransport
-		}(http.DefaultClient.Transport)
-		if conn.Get("cert").Exists() {
-			caCertPool := x509.NewCertPool()
-			caCertPool.AppendCertsFromPEM([]byte(conn.Get("cert").String()))
-
-			http.DefaultClient.Transport = &http.Transport{
-				TLSClientConfig: &tls.Config{RootCAs: caCertPool},
-			}
-		} else {
-			http.DefaultClient.Transport = &http.Transport{
-				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-			}
-		}
+	return inv.Payee, nil
+}
 
-		body, _ := sjson.Set("{}", "description_hash", b64h)
-		body, _ = sjson.Set(body, "value", msatoshi/1000)
-		body, _ = sjson.Set(body, "preimage", base64.StdEncoding.EncodeToString(preimage))
-		body, _ = sjson.Set(body, "expiry", strconv.Itoa(expiry))
+// custodialWalletId can't return just the node id, since many wallets live on
+// the same custodial node and each must be stored as a different backend.
+func custodialWalletId(ln LightningBackend, walletParts ...string) (string, error) {
+	nodeId, err := nodeIdFromInvoice(ln)
+	if err != nil {
+		return "", err
+	}
 
-		req, err := http.NewRequest("POST",
-			conn.Get("endpoint").String()+"/v1/invoices",
-			bytes.NewBufferString(body),
-		)
-		if err != nil {
-			return "", err
-		}
-		req.Header.Set("Grpc-Metadata-macaroon", conn.Get("macaroon").String())
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			return "", err
-		}
-		if resp.StatusCode >= 300 {
-			return "", errors.New("call to lnd failed")
+	wallet := sha256.Sum256([]byte(strings.Join(walletParts, "/")))
+	return nodeId + ":" + hex.EncodeToString(wallet[:8]), nil
+}
+
+// pollInvoice is a WaitInvoice for backends that can't wait on an invoice.
+func pollInvoice(
+	ctx context.Context,
+	check func(ctx context.Context) (InvoiceStatus, error),
+) (InvoiceStatus, error) {
+	for {
+		status, err := check(ctx)
+		if err != nil || status.Paid {
+			return status, err
 		}
-		defer resp.Body.Close()
-		b, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return "", err
+
+		select {
+		case <-ctx.Done():
+			return InvoiceStatus{}, nil
+		case <-time.After(5 * time.Second):
 		}
+	}
+}
 
-		return gjson.ParseBytes(b).Get("payment_request").String(), nil
-	case "lntxbot":
-		key := conn.Get("key").String()
+func (b Backend) MakeInvoice(msatoshi int64, description string, preimage []byte, expiry int) (bolt11 string, err error) {
+	log.Debug().Str("conn", b.Redacted()).Int64("msatoshi", msatoshi).
+		Msg("making invoice")
 
-		body, _ := sjson.Set("{}", "description_hash", hexh)
-		body, _ = sjson.Set(body, "amt", strconv.FormatInt(msatoshi/1000, 10))
-		body, _ = sjson.Set(body, "preimage", hex.EncodeToString(preimage))
+	ln, err := b.lightning()
+	if err != nil {
+		return "", err
+	}
 
-		req, err := http.NewRequest("POST",
-			"https://lntxbot.bigsun.xyz/addinvoice",
-			bytes.NewBufferString(body),
-		)
-		if err != nil {
-			return "", err
-		}
-		req.Header.Set("Authorization", key)
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			return "", err
-		}
-		defer resp.Body.Close()
-		b, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return "", err
-		}
+	return ln.MakeInvoice(msatoshi, description, preimage, expiry)
+}
 
-		inv := gjson.ParseBytes(b)
-		if inv.Get("error").Bool() {
-			return "", fmt.Errorf("Call to lntxbot failed: %s",
-				inv.Get("message").String())
-		}
+func (b Backend) MakeHoldInvoice(msatoshi int64, description string, preimage []byte, expiry int) (bolt11 string, err error) {
+	log.Debug().Str("conn", b.Redacted()).Int64("msatoshi", msatoshi).
+		Msg("making hold invoice")
 
-		return inv.Get("pay_req").String(), nil
-	default:
-		return "", errors.New("unsupported lightning server kind: " + b.Kind)
+	hold, err := b.holdInvoices()
+	if err != nil {
+		return "", err
 	}
+
+	return hold.MakeHoldInvoice(msatoshi, description, preimage, expiry)
 }
 
-func (backend Backend) waitInvoicePaid(hash string) bool {
-	ctx, cancel := context.WithTimeout(
+// payments may still arrive a little after the invoice expires
+const invoiceGracePeriod = time.Minute
+
+func (backend Backend) waitInvoicePaid(hash string, expiresAt time.Time) InvoiceStatus {
+	ctx, cancel := context.WithDeadline(
 		context.Background(),
-		30*time.Minute,
+		expiresAt.Add(invoiceGracePeriod),
 	)
 	defer cancel()
 
-	paid := backend.waitInvoice(ctx, hash)
-	return paid
+	return backend.waitInvoice(ctx, hash)
 }
 
-func (backend *Backend) waitInvoice(ctx context.Context, hash string) bool {
-	conn := backend.Conn()
-
+func (backend *Backend) waitInvoice(ctx context.Context, hash string) InvoiceStatus {
 	logger := log.With().Str("hash", hash).Str("backend", backend.Kind).
-		Str("conn", conn.String()).Logger()
-
-	defer func(prevTransport http.RoundTripper) {
-		http.DefaultClient.Transport = prevTransport
-	}(http.DefaultClient.Transport)
+		Str("conn", backend.Redacted()).Logger()
 
-	if conn.Get("cert").Exists() {
-		caCertPool := x509.NewCertPool()
-		caCertPool.AppendCertsFromPEM([]byte(conn.Get("cert").String()))
-
-		http.DefaultClient.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{RootCAs: caCertPool},
-		}
-	} else {
-		http.DefaultClient.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}
+	ln, err := backend.lightning()
+	if err != nil {
+		logger.Warn().Err(err).Msg("can't wait for invoice")
+		return InvoiceStatus{}
 	}
 
 	for {
-		time.Sleep(5 * time.Second)
-
 		if ctx.Err() != nil {
-			return false
+			return InvoiceStatus{}
 		}
 
-		switch backend.Kind {
-		case "spark":
-			spark := &lightning.Client{
-				SparkURL:              conn.Get("endpoint").String(),
-				SparkToken:            conn.Get("key").String(),
-				CallTimeout:           time.Minute * 15,
-				DontCheckCertificates: !conn.Get("cert").Exists(), /* don't check if not */
-			}
-			_, err := spark.Call("waitinvoice", "lnurlpayserver/"+hash[:5])
-			if err != nil {
-				logger.Warn().Err(err).
-					Msg("error on spark waitinvoice")
-				continue
-			}
-
-			return true
-		case "lnd":
-			endpoint := conn.Get("endpoint").String()
-			macaroon := conn.Get("macaroon").String()
-
-			// get the add_index for this invoice
-			req, err := http.NewRequestWithContext(ctx,
-				"GET",
-				endpoint+"/v1/invoice/"+hash, nil)
-			if err != nil {
-				logger.Warn().Err(err).Msg("error preparing lnd request")
-				return false
-			}
-			req.Header.Set("Grpc-Metadata-macaroon", macaroon)
-			resp, err := http.DefaultClient.Do(req)
-			if err != nil {
-				logger.Warn().Err(err).Msg("error on lnd invoice/")
-				return false
-			}
-			if resp.StatusCode >= 300 {
-				logger.Warn().Err(err).Msg("error on lnd invoice/")
-				return false
-			}
-			defer resp.Body.Close()
-			b, err := ioutil.ReadAll(resp.Body)
-			if err != nil {
-				logger.Warn().Err(err).Msg("error reading lnd response")
-				return false
-			}
-			invdata := gjson.ParseBytes(b)
-			if invdata.Get("settled").Bool() {
-				// paid already, stop here
-				return true
-			}
-			addIndex := invdata.Get("add_index").String()
-
-			// now that we have the add_index we can listen to lnd's stream
-			req, err = http.NewRequestWithContext(ctx,
-				"GET",
-				endpoint+"/v1/invoices/subscribe?add_index="+addIndex, nil)
-			if err != nil {
-				logger.Warn().Err(err).Msg("error preparing lnd request")
-				return false
-			}
-			req.Header.Set("Grpc-Metadata-macaroon", macaroon)
-			resp, err = http.DefaultClient.Do(req)
-			if err != nil {
-				logger.Warn().Err(err).Msg("error on lnd invoices/subscribe")
-				return false
-			}
-			if resp.StatusCode >= 300 {
-				logger.Warn().Err(err).Msg("error on lnd invoices/subscribe")
-				return false
-			}
-
-			defer resp.Body.Close()
-			var settled struct {
-				Settled bool `json:"settled"`
-			}
-			decoder := json.NewDecoder(resp.Body)
-			err = decoder.Decode(&settled)
-			if err != nil || !settled.Settled {
-				logger.Warn().Err(err).
-					Msg("error on lnd subscribe")
-				continue
-			}
-
-			return true
-		case "lntxbot":
-			key := conn.Get("key").String()
-
-			req, err := http.NewRequest("GET",
-				"https://lntxbot.bigsun.xyz/invoicestatus/"+hash,
-				nil,
-			)
-			if err != nil {
-				logger.Warn().Err(err).Msg("error on lntxbot invoicestatus")
-				return false
-			}
-			req.Header.Set("Authorization", key)
-			resp, err := http.DefaultClient.Do(req)
-			if err != nil {
-				logger.Warn().Err(err).Msg("error on lntxbot invoicestatus")
-				return false
-			}
-			if resp.StatusCode >= 300 {
-				logger.Warn().Err(err).Msg("error on lntxbot invoicestatus")
-				return false
-			}
-
-			defer resp.Body.Close()
-			b, err := ioutil.ReadAll(resp.Body)
-			if err != nil {
-				logger.Warn().Err(err).Msg("error on lntxbot invoicestatus")
-				return false
-			}
-
-			inv := gjson.ParseBytes(b)
-			if inv.Get("error").Bool() {
-				logger.Warn().Err(err).Str("message", inv.Get("message").String()).
-					Msg("error on lntxbot invoicestatus")
-				return false
-			}
-
-			return inv.Get("preimage").String() != ""
-		default:
-			return false
+		status, err := ln.WaitInvoice(ctx, hash)
+		if err != nil {
+			// try again in a while
+			logger.Warn().Err(err).Msg("error waiting for invoice")
+			time.Sleep(5 * time.Second)
+			continue
 		}
+
+		return status
 	}
 }
 
-func (backend Backend) checkInvoice(hash string) bool {
-	conn := backend.Conn()
+func (backend Backend) checkInvoice(hash string) InvoiceStatus {
+	ln, err := backend.lightning()
+	if err != nil {
+		return InvoiceStatus{}
+	}
 
-	switch backend.Kind {
-	case "spark":
-		spark := &lightning.Client{
-			SparkURL:              conn.Get("endpoint").String(),
-			SparkToken:            conn.Get("key").String(),
-			CallTimeout:           time.Second * 10,
-			DontCheckCertificates: !conn.Get("cert").Exists(), /* don't check if not */
-		}
-		_, err := spark.Call("waitinvoice", "lnurlpayserver/"+hash[:5])
-		if err != nil {
-			return false
-		}
-		return true
-	case "lnd":
-		endpoint := conn.Get("endpoint").String()
-		macaroon := conn.Get("macaroon").String()
+	status, err := ln.CheckInvoice(hash)
+	if err != nil {
+		log.Debug().Err(err).Str("hash", hash).Str("backend", backend.Kind).
+			Msg("error checking invoice")
+		return InvoiceStatus{}
+	}
 
-		req, err := http.NewRequest("GET", endpoint+"/v1/invoice/"+hash, nil)
-		if err != nil {
-			return false
-		}
-		req.Header.Set("Grpc-Metadata-macaroon", macaroon)
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			return false
-		}
-		if resp.StatusCode >= 300 {
-			return false
-		}
-		defer resp.Body.Close()
-		b, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return false
-		}
-		invdata := gjson.ParseBytes(b)
-		if invdata.Get("settled").Bool() {
-			return true
-		}
-		return false
-	case "lntxbot":
-		key := conn.Get("key").String()
-
-		req, err := http.NewRequest("GET",
-			"https://lntxbot.bigsun.xyz/invoicestatus/"+hash+"?wait=false",
-			nil,
-		)
-		if err != nil {
-			return false
-		}
-		req.Header.Set("Authorization", key)
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			return false
-		}
-		if resp.StatusCode >= 300 {
-			return false
-		}
-		defer resp.Body.Close()
-		b, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return false
+	return status
+}
+
+// parseMsat reads amounts that may come as numbers or as "123msat" strings.
+func parseMsat(v gjson.Result) int64 {
+	if v.Type == gjson.String {
+		msat, _ := strconv.ParseInt(strings.TrimSuffix(v.String(), "msat"), 10, 64)
+		return msat
+	}
+	return v.Int()
+}
+
+func unixTime(v gjson.Result) time.Time {
+	if v.Int() == 0 {
+		return time.Time{}
+	}
+	return time.Unix(v.Int(), 0)
+}
+
+func requireStrings(conn gjson.Result, required []string, optional []string) error {
+	for _, key := range required {
+		if conn.Get(key).Type != gjson.String {
+			return fmt.Errorf("connection.%s must be a string", key)
 		}
-		inv := gjson.ParseBytes(b)
-		if inv.Get("error").Bool() {
-			return false
+	}
+	for _, key := range optional {
+		if v := conn.Get(key); v.Exists() && v.Type != gjson.String {
+			return fmt.Errorf("connection.%s must be a string", key)
 		}
-		return inv.Get("preimage").String() != ""
-	default:
-		return false
 	}
+	return nil
 }
@@ -104,7 +104,7 @@ export default class Shop extends Component {
             <h1>{shop.id}</h1>
             <br />
             <div class="columns">
-              <TileCompact title="Backend" subtitle={shop.backend} />
+              <TileCompact title="Backends" subtitle={shop.backends.join(', ')} />
               <TileCompact title="Key" subtitle={shop.key} />
               <TileCompact title="Message" subtitle={shop.message} />
               <TileCompact
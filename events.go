@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/fiatjaf/lnurlpayserver/webhook"
+)
+
+const (
+	EVENT_INVOICE_CREATED  = "invoice.created"
+	EVENT_INVOICE_HELD     = "invoice.held"
+	EVENT_INVOICE_PAID     = "invoice.paid"
+	EVENT_INVOICE_EXPIRED  = "invoice.expired"
+	EVENT_TEMPLATE_UPDATED = "template.updated"
+	EVENT_BACKEND_DOWN     = "backend.down"
+)
+
+// API versions change the shape of event data. Shops are pinned to one so
+// their webhooks don't change when we add a new one.
+const LATEST_API_VERSION = "2026-10-18"
+
+var apiVersions = []string{
+	"2026-10-18",
+}
+
+func isApiVersion(version string) bool {
+	for _, v := range apiVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+var webhookEvents = []string{
+	EVENT_INVOICE_CREATED,
+	EVENT_INVOICE_HELD,
+	EVENT_INVOICE_PAID,
+	EVENT_INVOICE_EXPIRED,
+	EVENT_TEMPLATE_UPDATED,
+	EVENT_BACKEND_DOWN,
+}
+
+// WebhookEndpoint is a URL that gets the events it subscribed to, optionally
+// only those related to a single template.
+type WebhookEndpoint struct {
+	Id       string               `db:"id" json:"id"`
+	Shop     string               `db:"shop" json:"shop"`
+	URL      string               `db:"url" json:"url"`
+	Events   DelimitedStringArray `db:"events" json:"events"`
+	Template string               `db:"template" json:"template,omitempty"`
+	Created  time.Time            `db:"created" json:"created"`
+}
+
+const WEBHOOKFIELDS = `id, shop, url, array_to_string(events, '|') AS events, coalesce(template, '') AS template, created`
+
+func (endpoint WebhookEndpoint) Validate() error {
+	u, err := url.Parse(endpoint.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be an http or https URL")
+	}
+
+	if len(endpoint.Events) == 0 {
+		return errors.New("at least one event must be given")
+	}
+	for _, event := range endpoint.Events {
+		known := false
+		for _, e := range webhookEvents {
+			if e == event {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return errors.New("unknown event " + event)
+		}
+	}
+
+	return nil
+}
+
+// emitEvent sends the event to every endpoint of the shop subscribed to it.
+// templateId is empty for events that aren't about a template.
+func emitEvent(shopId string, event string, templateId string, data interface{}) {
+	var endpoints []WebhookEndpoint
+	err := pg.Select(&endpoints, `
+      SELECT `+WEBHOOKFIELDS+`
+      FROM webhook
+      WHERE shop = $1 AND $2 = ANY(events)
+        AND (template IS NULL OR template = $3)
+    `, shopId, event, templateId)
+	if err != nil {
+		log.Error().Err(err).Str("shop", shopId).Str("event", event).
+			Msg("failed to get webhook endpoints")
+		return
+	}
+	if len(endpoints) == 0 {
+		return
+	}
+
+	var version string
+	err = pg.Get(&version, `SELECT api_version FROM shop WHERE id = $1`, shopId)
+	if err != nil {
+		log.Error().Err(err).Str("shop", shopId).Msg("failed to get shop api version")
+		return
+	}
+
+	eventId := newEventId()
+	body, err := newEvent(eventId, version, event, data)
+	if err != nil {
+		log.Error().Err(err).Str("event", event).Msg("failed to encode event")
+		return
+	}
+
+	for _, endpoint := range endpoints {
+		enqueueWebhook(endpoint, event, eventId, body)
+	}
+}
+
+func newEvent(id string, version string, event string, data interface{}) ([]byte, error) {
+	var edata interface{}
+	switch version {
+	case "2026-10-18":
+		switch v := data.(type) {
+		case Invoice:
+			edata = invoiceEventData(v)
+		case Template:
+			edata = templateEventData(v)
+		case BackendHealth:
+			edata = backendEventData(v)
+		}
+	}
+	if edata == nil {
+		return nil, fmt.Errorf("no %T data for API version %s", data, version)
+	}
+
+	jdata, err := json.Marshal(edata)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(webhook.Event{
+		Id:         id,
+		Type:       event,
+		Created:    time.Now().UTC(),
+		ApiVersion: version,
+		Data:       jdata,
+	})
+}
+
+// event data as of API version 2026-10-18
+
+type InvoiceEventData struct {
+	Hash           string             `json:"hash"`
+	Status         string             `json:"status"`
+	Shop           string             `json:"shop"`
+	Template       *TemplateEventData `json:"template"`
+	Params         map[string]string  `json:"params"`
+	Description    string             `json:"description"`
+	Bolt11         string             `json:"bolt11"`
+	AmountMsat     int64              `json:"amount_msat"`
+	AmountPaidMsat *int64             `json:"amount_paid_msat"`
+	Quote          *QuoteEventData    `json:"quote"`
+	Hold           bool               `json:"hold"`
+	Flags          []string           `json:"flags"`
+	Created        time.Time          `json:"created"`
+	ExpiresAt      time.Time          `json:"expires_at"`
+	PaidAt         *time.Time         `json:"paid_at"`
+}
+
+type QuoteEventData struct {
+	Currency string    `json:"currency"`
+	Amount   float64   `json:"amount"`
+	Rate     float64   `json:"rate"`
+	Source   string    `json:"source"`
+	Time     time.Time `json:"time"`
+}
+
+type TemplateEventData struct {
+	Id            string   `json:"id"`
+	Shop          string   `json:"shop"`
+	PathParams    []string `json:"path_params"`
+	QueryParams   []string `json:"query_params"`
+	Description   string   `json:"description"`
+	Currency      string   `json:"currency"`
+	MinPrice      string   `json:"min_price"`
+	MaxPrice      string   `json:"max_price"`
+	Hold          bool     `json:"hold"`
+	InvoiceExpiry int      `json:"invoice_expiry"`
+}
+
+type BackendEventData struct {
+	Id          string     `json:"id"`
+	Kind        string     `json:"kind"`
+	Error       string     `json:"error"`
+	LastSuccess *time.Time `json:"last_success"`
+	CheckedAt   *time.Time `json:"checked_at"`
+}
+
+func invoiceEventData(inv Invoice) InvoiceEventData {
+	data := InvoiceEventData{
+		Hash:           inv.Hash,
+		Status:         inv.Status,
+		Shop:           inv.Shop,
+		Params:         make(map[string]string),
+		Description:    inv.Description,
+		Bolt11:         inv.Bolt11,
+		AmountMsat:     inv.AmountMsat,
+		AmountPaidMsat: inv.AmountPaidMsat,
+		Hold:           inv.Hold,
+		Flags:          append([]string{}, inv.Flags...),
+		Created:        inv.Creation,
+		ExpiresAt:      inv.ExpiresAt,
+		PaidAt:         inv.Payment,
+	}
+	inv.Params.Unmarshal(&data.Params)
+	if inv.FiatAmount != nil && inv.Rate != nil && inv.RateSource != nil && inv.RateTime != nil {
+		data.Quote = &QuoteEventData{
+			Currency: inv.Currency,
+			Amount:   *inv.FiatAmount,
+			Rate:     *inv.Rate,
+			Source:   *inv.RateSource,
+			Time:     *inv.RateTime,
+		}
+	}
+	if err := inv.loadTemplate(); err == nil {
+		t := templateEventData(*inv.template)
+		data.Template = &t
+	}
+	return data
+}
+
+func templateEventData(t Template) TemplateEventData {
+	return TemplateEventData{
+		Id:            t.Id,
+		Shop:          t.Shop,
+		PathParams:    append([]string{}, t.PathParams...),
+		QueryParams:   append([]string{}, t.QueryParams...),
+		Description:   t.Description,
+		Currency:      t.Currency,
+		MinPrice:      t.MinPrice,
+		MaxPrice:      t.MaxPrice,
+		Hold:          t.Hold,
+		InvoiceExpiry: t.InvoiceExpiry,
+	}
+}
+
+func backendEventData(health BackendHealth) BackendEventData {
+	return BackendEventData{
+		Id:          health.Backend,
+		Kind:        health.Kind,
+		Error:       health.LastError,
+		LastSuccess: health.LastSuccess,
+		CheckedAt:   health.LastCheck,
+	}
+}
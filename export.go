@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var exportColumns = []string{
+	"hash", "creation", "template", "description", "status", "amount_msat",
+	"amt_paid_msat", "payment", "currency", "fiat_amount", "rate",
+	"rate_source", "rate_time", "flags",
+}
+
+// exportInvoices streams all the invoices matching the same filters as
+// listInvoices (usually just from and to), as CSV or JSON Lines.
+func exportInvoices(w http.ResponseWriter, r *http.Request) {
+	shop := r.Context().Value("shop").(*Shop)
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "jsonl" {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(Response{false, "format must be csv or jsonl"})
+		return
+	}
+
+	filter, err := parseInvoiceFilter(shop.Id, r)
+	if err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(Response{false, err.Error()})
+		return
+	}
+	where, args := filter.where()
+
+	// every params key becomes a column
+	var paramKeys []string
+	err = pg.Select(&paramKeys, `
+      SELECT DISTINCT jsonb_object_keys(params) FROM invoice
+      WHERE `+where, args...)
+	if err != nil {
+		json.NewEncoder(w).Encode(Response{false, err.Error()})
+		return
+	}
+	sort.Strings(paramKeys)
+
+	rows, err := pg.Queryx(`
+      SELECT `+INVOICEFIELDS+`
+      FROM invoice
+      WHERE `+where+`
+      ORDER BY creation, hash
+    `, args...)
+	if err != nil {
+		json.NewEncoder(w).Encode(Response{false, err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	// big exports take longer than the server WriteTimeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	filename := shop.Id + "-invoices." + format
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+
+	var writeRow func(record map[string]string)
+	var csvw *csv.Writer
+	if format == "csv" {
+		csvw = csv.NewWriter(w)
+		header := append([]string{}, exportColumns...)
+		for _, key := range paramKeys {
+			header = append(header, "param."+key)
+		}
+		csvw.Write(header)
+
+		writeRow = func(record map[string]string) {
+			line := make([]string, 0, len(exportColumns)+len(paramKeys))
+			for _, col := range exportColumns {
+				line = append(line, record[col])
+			}
+			for _, key := range paramKeys {
+				line = append(line, record["param."+key])
+			}
+			csvw.Write(line)
+		}
+	} else {
+		enc := json.NewEncoder(w)
+		writeRow = func(record map[string]string) {
+			enc.Encode(record)
+		}
+	}
+
+	flusher, _ := w.(http.Flusher)
+	n := 0
+	for rows.Next() {
+		var inv Invoice
+		if err := rows.StructScan(&inv); err != nil {
+			log.Warn().Err(err).Str("shop", shop.Id).Msg("failed to scan exported invoice")
+			return
+		}
+
+		writeRow(exportRecord(inv))
+
+		n++
+		if n%500 == 0 {
+			if csvw != nil {
+				csvw.Flush()
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+	if csvw != nil {
+		csvw.Flush()
+	}
+	if err := rows.Err(); err != nil {
+		log.Warn().Err(err).Str("shop", shop.Id).Msg("invoice export interrupted")
+	}
+}
+
+func exportRecord(inv Invoice) map[string]string {
+	record := map[string]string{
+		"hash":        inv.Hash,
+		"creation":    inv.Creation.Format(time.RFC3339),
+		"template":    inv.Template,
+		"description": inv.Description,
+		"status":      inv.Status,
+		"amount_msat": strconv.FormatInt(inv.AmountMsat, 10),
+		"currency":    inv.Currency,
+		"flags":       strings.Join(inv.Flags, " "),
+	}
+	if inv.AmountPaidMsat != nil {
+		record["amt_paid_msat"] = strconv.FormatInt(*inv.AmountPaidMsat, 10)
+	}
+	if inv.Payment != nil {
+		record["payment"] = inv.Payment.Format(time.RFC3339)
+	}
+	if inv.Rate != nil {
+		record["rate"] = strconv.FormatFloat(*inv.Rate, 'f', -1, 64)
+	}
+	if inv.FiatAmount != nil {
+		record["fiat_amount"] = strconv.FormatFloat(*inv.FiatAmount, 'f', 2, 64)
+	}
+	if inv.RateSource != nil {
+		record["rate_source"] = *inv.RateSource
+	}
+	if inv.RateTime != nil {
+		record["rate_time"] = inv.RateTime.Format(time.RFC3339)
+	}
+
+	var params map[string]interface{}
+	json.Unmarshal(inv.Params, &params)
+	for key, value := range params {
+		if s, ok := value.(string); ok {
+			record["param."+key] = s
+		} else {
+			j, _ := json.Marshal(value)
+			record["param."+key] = string(j)
+		}
+	}
+
+	return record
+}
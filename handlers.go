@@ -4,12 +4,17 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/fiatjaf/go-lnurl"
 	"github.com/gorilla/mux"
+	"github.com/tidwall/sjson"
 )
 
 type Response struct {
@@ -65,6 +70,30 @@ func getShop(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(r.Context().Value("shop").(*Shop))
 }
 
+func rotateWebhookSecret(w http.ResponseWriter, r *http.Request) {
+	shop := r.Context().Value("shop").(*Shop)
+
+	// the old secret keeps working for a while, unless it's rotated again
+	var secret string
+	err := pg.Get(&secret, `
+      UPDATE shop
+      SET webhook_secret_old = webhook_secret,
+          webhook_secret = $2,
+          webhook_secret_rotated = now()
+      WHERE id = $1
+      RETURNING webhook_secret
+    `, shop.Id, newWebhookSecret())
+	if err != nil {
+		log.Warn().Err(err).Str("shop", shop.Id).Msg("failed to rotate webhook secret")
+		json.NewEncoder(w).Encode(Response{false, err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(struct {
+		WebhookSecret string `json:"webhook_secret"`
+	}{secret})
+}
+
 func setShop(w http.ResponseWriter, r *http.Request) {
 	shopId := mux.Vars(r)["shop"]
 
@@ -75,21 +104,34 @@ func setShop(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// parse shop data
-	var shop Shop
-	err = json.Unmarshal(body, &shop)
+	// parse backend data, either a single one or a list in order of preference
+	var payload struct {
+		Backends []Backend `json:"backends"`
+	}
+	err = json.Unmarshal(body, &payload)
 	if err != nil {
 		json.NewEncoder(w).Encode(Response{false, err.Error()})
 		return
 	}
-
-	// parse backend data
+	backends := payload.Backends
 	var backend Backend
 	err = json.Unmarshal(body, &backend)
 	if err != nil {
 		json.NewEncoder(w).Encode(Response{false, err.Error()})
 		return
 	}
+	if len(backends) == 0 && backend.Kind != "" {
+		backends = []Backend{backend}
+	}
+
+	// parse shop data
+	var shop Shop
+	shopBody, _ := sjson.DeleteBytes(body, "backends")
+	err = json.Unmarshal(shopBody, &shop)
+	if err != nil {
+		json.NewEncoder(w).Encode(Response{false, err.Error()})
+		return
+	}
 
 	txn, err := pg.Beginx()
 	if err != nil {
@@ -101,7 +143,7 @@ func setShop(w http.ResponseWriter, r *http.Request) {
 	existingShop, shopExists := r.Context().Value("shop").(*Shop)
 	_, _, keyProvided := r.BasicAuth()
 	shopDataProvided := len(shop.Verification) != 0
-	backendDataProvided := backend.Kind != ""
+	backendDataProvided := len(backends) > 0
 	backendMatchesShop := false
 
 	if !shopDataProvided {
@@ -111,35 +153,66 @@ func setShop(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if backendDataProvided {
-		err = backend.GetId()
-		if err != nil {
-			json.NewEncoder(w).Encode(
-				Response{false, "failed to get node id: " + err.Error()})
-			return
-		}
+		shop.Backends = make(DelimitedStringArray, len(backends))
+		backendMatchesShop = shopExists
+
+		for i, backend := range backends {
+			backend.applyDefaults(shopId)
+			err = backend.Validate()
+			if err != nil {
+				w.WriteHeader(400)
+				json.NewEncoder(w).Encode(
+					Response{false, "invalid backend: " + err.Error()})
+				return
+			}
 
-		// always store the backend
-		_, err = txn.Exec(`
-          INSERT INTO backend (id, kind, connection)
-          VALUES ($1, $2, $3)
-          ON CONFLICT (id) DO UPDATE SET
-            kind = $2,
-            connection = $3
-        `, backend.Id, backend.Kind, backend.Connection)
-		if err != nil {
-			log.Error().Err(err).Interface("backend", backend).
-				Msg("invalid backend upsert")
-			w.WriteHeader(400)
-			json.NewEncoder(w).Encode(Response{false, "missing data or key or backend"})
-			return
-		}
+			err = backend.GetId()
+			if err != nil {
+				json.NewEncoder(w).Encode(
+					Response{false, "failed to get node id: " + err.Error()})
+				return
+			}
 
-		if shopExists {
-			backendMatchesShop = existingShop.Backend == backend.Id
-		}
+			sealed, err := backend.SealedConnection()
+			if err != nil {
+				log.Error().Err(err).Str("backend", backend.Id).
+					Msg("failed to encrypt backend connection")
+				json.NewEncoder(w).Encode(Response{false, "failed to store backend"})
+				return
+			}
 
-		// will always update backend (or leave unchanged)
-		shop.Backend = backend.Id
+			// always store the backend
+			_, err = txn.Exec(`
+              INSERT INTO backend (id, kind, connection)
+              VALUES ($1, $2, $3)
+              ON CONFLICT (id) DO UPDATE SET
+                kind = $2,
+                connection = $3
+            `, backend.Id, backend.Kind, sealed)
+			if err != nil {
+				log.Error().Err(err).Interface("backend", backend).
+					Msg("invalid backend upsert")
+				w.WriteHeader(400)
+				json.NewEncoder(w).Encode(Response{false, "missing data or key or backend"})
+				return
+			}
+
+			// without a key, one must prove they own all the backends already
+			// used by this shop
+			if shopExists {
+				found := false
+				for _, id := range existingShop.Backends {
+					if id == backend.Id {
+						found = true
+						break
+					}
+				}
+				backendMatchesShop = backendMatchesShop && found
+			}
+
+			// will always update backends (or leave unchanged)
+			shop.Backends[i] = backend.Id
+		}
 	}
 
 	shop.Id = shopId
@@ -152,28 +225,42 @@ func setShop(w http.ResponseWriter, r *http.Request) {
 		// invalid operation
 		log.Warn().
 			Interface("shop", shop).
-			Interface("backend", backend).
+			Interface("backends", backends).
 			Msg("invalid shop set action")
 		w.WriteHeader(400)
 		json.NewEncoder(w).Encode(Response{false, "missing data or key or backend"})
 		return
 	}
 
-	// insert or update while also updating backend
+	// existing shops stay on their version unless they ask to upgrade
+	if shop.ApiVersion == "" {
+		if shopExists {
+			shop.ApiVersion = existingShop.ApiVersion
+		} else {
+			shop.ApiVersion = LATEST_API_VERSION
+		}
+	}
+	if !isApiVersion(shop.ApiVersion) {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(Response{false, "unknown api_version " + shop.ApiVersion})
+		return
+	}
+
 	_, err = txn.Exec(`
       INSERT INTO shop
-        (id, backend, message, verification, webhook)
-      VALUES ($1, $2, $3, $4, $5)
+        (id, message, verification, retention_days, webhook_secret, api_version)
+      VALUES ($1, $2, $3, $4, $5, $6)
       ON CONFLICT (id) DO UPDATE SET
-        backend = $2,
-        message = $3,
-        verification = $4,
-        webhook = $5
+        message = $2,
+        verification = $3,
+        retention_days = $4,
+        api_version = $6
     `, shop.Id,
-		shop.Backend,
 		sql.NullString{String: shop.Message, Valid: shop.Message != ""},
 		shop.Verification,
-		sql.NullString{String: shop.Webhook, Valid: shop.Webhook != ""},
+		shop.RetentionDays,
+		newWebhookSecret(),
+		shop.ApiVersion,
 	)
 	if err != nil {
 		log.Error().Err(err).Interface("shop", shop).Msg("failed to upsert shop")
@@ -181,6 +268,28 @@ func setShop(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if backendDataProvided {
+		// replace the list of backends
+		_, err = txn.Exec(`DELETE FROM shop_backend WHERE shop = $1`, shop.Id)
+		if err != nil {
+			json.NewEncoder(w).Encode(Response{false, err.Error()})
+			return
+		}
+		for position, backendId := range shop.Backends {
+			_, err = txn.Exec(`
+              INSERT INTO shop_backend (shop, backend, position)
+              VALUES ($1, $2, $3)
+            `, shop.Id, backendId, position)
+			if err != nil {
+				log.Error().Err(err).Str("shop", shop.Id).Str("backend", backendId).
+					Msg("failed to set shop backend")
+				w.WriteHeader(400)
+				json.NewEncoder(w).Encode(Response{false, err.Error()})
+				return
+			}
+		}
+	}
+
 	// key will be created automatically if shop is new
 	if shop.Key == "" {
 		err = txn.Get(&shop.Key, `SELECT key FROM shop WHERE id = $1`, shop.Id)
@@ -201,6 +310,23 @@ func setShop(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(shop.Key)
 }
 
+func getBackendStatus(w http.ResponseWriter, r *http.Request) {
+	shop := r.Context().Value("shop").(*Shop)
+
+	backends, err := BackendsFromShop(shop.Id)
+	if err != nil {
+		json.NewEncoder(w).Encode(Response{false, err.Error()})
+		return
+	}
+
+	statuses := make([]BackendHealth, len(backends))
+	for i, backend := range backends {
+		statuses[i] = getBackendHealth(backend)
+	}
+
+	json.NewEncoder(w).Encode(statuses)
+}
+
 func listTemplates(w http.ResponseWriter, r *http.Request) {
 	shop := r.Context().Value("shop").(*Shop)
 
@@ -234,26 +360,30 @@ func setTemplate(w http.ResponseWriter, r *http.Request) {
 	}
 	t.Id = tplId
 	t.Shop = shop.Id
+	if t.InvoiceExpiry == 0 {
+		t.InvoiceExpiry = DEFAULT_INVOICE_EXPIRY
+	}
 
 	_, err = pg.Exec(`
           INSERT INTO template
             (id, shop, path_params, query_params, description, image,
-             currency, min_price, max_price)
+             currency, min_price, max_price, hold, invoice_expiry)
           VALUES (
             $1, $2,
             array_remove(string_to_array($3, '|'), ''),
             array_remove(string_to_array($4, '|'), ''),
-            $5, $6, $7, $8, $9
+            $5, $6, $7, $8, $9, $10, $11
           )
           ON CONFLICT (shop, id) DO UPDATE SET
             path_params = array_remove(string_to_array($3, '|'), ''),
             query_params = array_remove(string_to_array($4, '|'), ''),
             description = $5, image = $6,
-            currency = $7, min_price = $8, max_price = $9
+            currency = $7, min_price = $8, max_price = $9,
+            hold = $10, invoice_expiry = $11
         `, t.Id, t.Shop,
 		t.PathParams, t.QueryParams,
 		t.Description, sql.NullString{String: t.Image, Valid: t.Image != ""},
-		t.Currency, t.MinPrice, t.MaxPrice,
+		t.Currency, t.MinPrice, t.MaxPrice, t.Hold, t.InvoiceExpiry,
 	)
 	if err != nil {
 		log.Warn().Err(err).Interface("template", t).Msg("failed to save template")
@@ -261,6 +391,8 @@ func setTemplate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	go emitEvent(t.Shop, EVENT_TEMPLATE_UPDATED, t.Id, t)
+
 	json.NewEncoder(w).Encode(Response{Ok: true})
 	return
 }
@@ -335,37 +467,446 @@ func getLNURL(w http.ResponseWriter, r *http.Request) {
 func listInvoices(w http.ResponseWriter, r *http.Request) {
 	shop := r.Context().Value("shop").(*Shop)
 
-	invoices := make([]Invoice, 0, 30)
-	err := pg.Select(`
+	filter, err := parseInvoiceFilter(shop.Id, r)
+	if err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(Response{false, err.Error()})
+		return
+	}
+	where, args := filter.where()
+
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 || limit > 500 {
+		limit = 50
+	}
+
+	var totals struct {
+		Count       int64 `db:"count" json:"count"`
+		SumMsat     int64 `db:"sum_msat" json:"sum_msat"`
+		PaidCount   int64 `db:"paid_count" json:"paid_count"`
+		PaidSumMsat int64 `db:"paid_sum_msat" json:"paid_sum_msat"`
+	}
+	err = pg.Get(&totals, `
+      SELECT count(*) AS count,
+             coalesce(sum(amount_msat), 0) AS sum_msat,
+             count(*) FILTER (WHERE status = 'paid') AS paid_count,
+             coalesce(sum(coalesce(amt_paid_msat, amount_msat))
+               FILTER (WHERE status = 'paid'), 0) AS paid_sum_msat
+      FROM invoice
+      WHERE `+where, args...)
+	if err != nil {
+		json.NewEncoder(w).Encode(Response{false, err.Error()})
+		return
+	}
+
+	if cursor := r.URL.Query().Get("cursor"); cursor != "" {
+		creation, hash, err := decodeInvoiceCursor(cursor)
+		if err != nil {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{false, "invalid cursor"})
+			return
+		}
+		args = append(args, creation, hash)
+		where += " AND (creation, hash) < ($" + strconv.Itoa(len(args)-1) +
+			", $" + strconv.Itoa(len(args)) + ")"
+	}
+
+	// get one more so we know if there is a next page
+	invoices := make([]Invoice, 0, limit+1)
+	err = pg.Select(&invoices, `
       SELECT `+INVOICEFIELDS+`
       FROM invoice
-      WHERE invoice.shop = $1
-      ORDER BY time DESC
-      LIMIT 30
-    `, shop.Id)
+      WHERE `+where+`
+      ORDER BY creation DESC, hash DESC
+      LIMIT `+strconv.Itoa(limit+1), args...)
 	if err != nil {
 		json.NewEncoder(w).Encode(Response{false, err.Error()})
 		return
 	}
 
-	json.NewEncoder(w).Encode(invoices)
+	next := ""
+	if len(invoices) > limit {
+		invoices = invoices[:limit]
+		next = encodeInvoiceCursor(invoices[limit-1])
+	}
+
+	json.NewEncoder(w).Encode(struct {
+		Invoices   []Invoice   `json:"invoices"`
+		NextCursor string      `json:"next_cursor,omitempty"`
+		Totals     interface{} `json:"totals"`
+	}{invoices, next, totals})
 }
 
 func getInvoice(w http.ResponseWriter, r *http.Request) {
 	shop := r.Context().Value("shop").(*Shop)
 	hash := mux.Vars(r)["hash"]
 
-	var invoice Invoice
-	err := pg.Select(`
-      SELECT `+INVOICEFIELDS+`
-      FROM invoice
-      WHERE invoice.hash = $1
-        AND invoice.shop = $2
+	invoice, err := InvoiceByHash(shop.Id, hash)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(404)
+		json.NewEncoder(w).Encode(Response{false, "invoice not found"})
+		return
+	} else if err != nil {
+		json.NewEncoder(w).Encode(Response{false, err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(invoice)
+}
+
+func settleInvoice(w http.ResponseWriter, r *http.Request) {
+	shop := r.Context().Value("shop").(*Shop)
+	hash := mux.Vars(r)["hash"]
+
+	invoice, err := InvoiceByHash(shop.Id, hash)
+	if err != nil {
+		w.WriteHeader(404)
+		json.NewEncoder(w).Encode(Response{false, "invoice not found"})
+		return
+	}
+
+	err = invoice.Settle()
+	if err != nil {
+		log.Warn().Err(err).Str("hash", hash).Msg("failed to settle invoice")
+		json.NewEncoder(w).Encode(Response{false, err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(Response{Ok: true})
+}
+
+func cancelInvoice(w http.ResponseWriter, r *http.Request) {
+	shop := r.Context().Value("shop").(*Shop)
+	hash := mux.Vars(r)["hash"]
+
+	invoice, err := InvoiceByHash(shop.Id, hash)
+	if err != nil {
+		w.WriteHeader(404)
+		json.NewEncoder(w).Encode(Response{false, "invoice not found"})
+		return
+	}
+
+	err = invoice.Cancel()
+	if err != nil {
+		log.Warn().Err(err).Str("hash", hash).Msg("failed to cancel invoice")
+		json.NewEncoder(w).Encode(Response{false, err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(Response{Ok: true})
+}
+
+func payFakeInvoice(w http.ResponseWriter, r *http.Request) {
+	shop := r.Context().Value("shop").(*Shop)
+	hash := mux.Vars(r)["hash"]
+
+	var kind string
+	err := pg.Get(&kind, `
+      SELECT backend.kind FROM invoice
+      INNER JOIN backend ON invoice.backend = backend.id
+      WHERE invoice.hash = $1 AND invoice.shop = $2
     `, hash, shop.Id)
+	if err != nil {
+		w.WriteHeader(404)
+		json.NewEncoder(w).Encode(Response{false, "invoice not found"})
+		return
+	}
+	if kind != "fake" {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(Response{false, "only invoices from fake backends can be paid like this"})
+		return
+	}
+
+	// to simulate overpayments
+	amount, _ := strconv.ParseInt(r.URL.Query().Get("amount_msat"), 10, 64)
+
+	err = fakePayInvoice(hash, amount)
 	if err != nil {
 		json.NewEncoder(w).Encode(Response{false, err.Error()})
 		return
 	}
 
-	json.NewEncoder(w).Encode(invoice)
+	json.NewEncoder(w).Encode(Response{Ok: true})
+}
+
+func listWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	shop := r.Context().Value("shop").(*Shop)
+	qs := r.URL.Query()
+
+	limit, _ := strconv.Atoi(qs.Get("limit"))
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+
+	// pages go backwards from the given time
+	before := time.Now()
+	if v := qs.Get("before"); v != "" {
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{false, "before must be an RFC3339 time"})
+			return
+		}
+		before = t
+	}
+
+	deliveries := make([]WebhookDelivery, 0, limit)
+	err := pg.Select(&deliveries, `
+      SELECT `+WEBHOOKDELIVERYFIELDS+`
+      FROM webhook_delivery
+      WHERE shop = $1 AND created < $2
+        AND ($3 = '' OR status = $3)
+      ORDER BY created DESC
+      LIMIT `+strconv.Itoa(limit),
+		shop.Id, before, qs.Get("status"))
+	if err != nil {
+		json.NewEncoder(w).Encode(Response{false, err.Error()})
+		return
+	}
+
+	for i := range deliveries {
+		if err := deliveries[i].loadAttempts(); err != nil {
+			json.NewEncoder(w).Encode(Response{false, err.Error()})
+			return
+		}
+	}
+
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+func getWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	shop := r.Context().Value("shop").(*Shop)
+	id := mux.Vars(r)["id"]
+
+	var delivery WebhookDelivery
+	err := pg.Get(&delivery, `
+      SELECT `+WEBHOOKDELIVERYFIELDS+`
+      FROM webhook_delivery
+      WHERE id = $1 AND shop = $2
+    `, id, shop.Id)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(404)
+		json.NewEncoder(w).Encode(Response{false, "delivery not found"})
+		return
+	} else if err != nil {
+		json.NewEncoder(w).Encode(Response{false, err.Error()})
+		return
+	}
+
+	if err := delivery.loadAttempts(); err != nil {
+		json.NewEncoder(w).Encode(Response{false, err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(delivery)
+}
+
+func retryWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	shop := r.Context().Value("shop").(*Shop)
+	id := mux.Vars(r)["id"]
+
+	err := retriggerWebhook(shop.Id, id)
+	if err != nil {
+		json.NewEncoder(w).Encode(Response{false, err.Error()})
+		return
+	}
+
+	getWebhookDelivery(w, r)
+}
+
+func listWebhooks(w http.ResponseWriter, r *http.Request) {
+	shop := r.Context().Value("shop").(*Shop)
+
+	endpoints := make([]WebhookEndpoint, 0)
+	err := pg.Select(&endpoints, `
+      SELECT `+WEBHOOKFIELDS+`
+      FROM webhook
+      WHERE shop = $1
+      ORDER BY created
+    `, shop.Id)
+	if err != nil {
+		json.NewEncoder(w).Encode(Response{false, err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(endpoints)
+}
+
+func createWebhook(w http.ResponseWriter, r *http.Request) {
+	shop := r.Context().Value("shop").(*Shop)
+
+	var endpoint WebhookEndpoint
+	defer r.Body.Close()
+	err := json.NewDecoder(r.Body).Decode(&endpoint)
+	if err == nil {
+		err = endpoint.Validate()
+	}
+	if err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(Response{false, err.Error()})
+		return
+	}
+
+	err = pg.Get(&endpoint, `
+      INSERT INTO webhook (id, shop, url, events, template)
+      VALUES ($1, $2, $3, string_to_array($4, '|'), $5)
+      RETURNING `+WEBHOOKFIELDS,
+		"wh_"+randomHex(8), shop.Id, endpoint.URL, endpoint.Events,
+		sql.NullString{String: endpoint.Template, Valid: endpoint.Template != ""})
+	if err != nil {
+		log.Warn().Err(err).Str("shop", shop.Id).Msg("failed to create webhook")
+		json.NewEncoder(w).Encode(Response{false, err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(endpoint)
+}
+
+func updateWebhook(w http.ResponseWriter, r *http.Request) {
+	shop := r.Context().Value("shop").(*Shop)
+	id := mux.Vars(r)["id"]
+
+	var endpoint WebhookEndpoint
+	defer r.Body.Close()
+	err := json.NewDecoder(r.Body).Decode(&endpoint)
+	if err == nil {
+		err = endpoint.Validate()
+	}
+	if err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(Response{false, err.Error()})
+		return
+	}
+
+	err = pg.Get(&endpoint, `
+      UPDATE webhook
+      SET url = $3, events = string_to_array($4, '|'), template = $5
+      WHERE id = $1 AND shop = $2
+      RETURNING `+WEBHOOKFIELDS,
+		id, shop.Id, endpoint.URL, endpoint.Events,
+		sql.NullString{String: endpoint.Template, Valid: endpoint.Template != ""})
+	if err == sql.ErrNoRows {
+		w.WriteHeader(404)
+		json.NewEncoder(w).Encode(Response{false, "webhook not found"})
+		return
+	} else if err != nil {
+		log.Warn().Err(err).Str("webhook", id).Msg("failed to update webhook")
+		json.NewEncoder(w).Encode(Response{false, err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(endpoint)
+}
+
+func deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	shop := r.Context().Value("shop").(*Shop)
+	id := mux.Vars(r)["id"]
+
+	_, err := pg.Exec(`
+      DELETE FROM webhook WHERE id = $1 AND shop = $2
+    `, id, shop.Id)
+	if err != nil {
+		log.Warn().Err(err).Str("webhook", id).Msg("failed to delete webhook")
+		json.NewEncoder(w).Encode(Response{false, err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(Response{Ok: true})
+}
+
+func testWebhook(w http.ResponseWriter, r *http.Request) {
+	shop := r.Context().Value("shop").(*Shop)
+
+	var params struct {
+		Webhook  string `json:"webhook"`
+		Event    string `json:"event"`
+		Template string `json:"template"`
+	}
+	defer r.Body.Close()
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil && err != io.EOF {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(Response{false, err.Error()})
+		return
+	}
+
+	switch params.Event {
+	case "":
+		params.Event = EVENT_INVOICE_PAID
+	case EVENT_INVOICE_CREATED, EVENT_INVOICE_HELD, EVENT_INVOICE_PAID, EVENT_INVOICE_EXPIRED:
+	default:
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(Response{false, "only invoice events can be tested"})
+		return
+	}
+
+	endpoints := make([]WebhookEndpoint, 0)
+	err = pg.Select(&endpoints, `
+      SELECT `+WEBHOOKFIELDS+`
+      FROM webhook
+      WHERE shop = $1 AND ($2 = '' OR id = $2)
+      ORDER BY created
+    `, shop.Id, params.Webhook)
+	if err != nil {
+		json.NewEncoder(w).Encode(Response{false, err.Error()})
+		return
+	}
+	if len(endpoints) == 0 {
+		w.WriteHeader(404)
+		json.NewEncoder(w).Encode(Response{false, "no webhooks to test"})
+		return
+	}
+
+	t := Template{
+		Id:          "test",
+		Shop:        shop.Id,
+		Description: "test invoice",
+		Currency:    "sat",
+		MinPrice:    "1",
+		MaxPrice:    "1",
+	}
+	if params.Template != "" {
+		err = pg.Get(&t, `
+          SELECT `+TEMPLATEFIELDS+` FROM template WHERE id = $1 AND shop = $2
+        `, params.Template, shop.Id)
+		if err == sql.ErrNoRows {
+			w.WriteHeader(404)
+			json.NewEncoder(w).Encode(Response{false, "template not found"})
+			return
+		} else if err != nil {
+			json.NewEncoder(w).Encode(Response{false, err.Error()})
+			return
+		}
+	}
+
+	eventId := newEventId()
+	body, err := newEvent(eventId, shop.ApiVersion, params.Event, testInvoice(t, params.Event))
+	if err != nil {
+		json.NewEncoder(w).Encode(Response{false, err.Error()})
+		return
+	}
+
+	type testResult struct {
+		Webhook string `json:"webhook"`
+		URL     string `json:"url"`
+		webhookResult
+		Error string `json:"error,omitempty"`
+	}
+	results := make([]testResult, len(endpoints))
+
+	var wg sync.WaitGroup
+	for i, endpoint := range endpoints {
+		wg.Add(1)
+		go func(i int, endpoint WebhookEndpoint) {
+			defer wg.Done()
+			result, err := shop.postWebhook(endpoint.URL, eventId, body)
+			results[i] = testResult{Webhook: endpoint.Id, URL: endpoint.URL, webhookResult: result}
+			if err != nil {
+				results[i].Error = err.Error()
+			}
+		}(i, endpoint)
+	}
+	wg.Wait()
+
+	json.NewEncoder(w).Encode(results)
 }
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	cmap "github.com/orcaman/concurrent-map"
+)
+
+type BackendHealth struct {
+	Backend     string     `json:"backend"`
+	Kind        string     `json:"kind"`
+	Up          bool       `json:"up"`
+	LatencyMs   int64      `json:"latency_ms"`
+	LastCheck   *time.Time `json:"last_check"`
+	LastSuccess *time.Time `json:"last_success"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+// results of the latest healthcheck of each backend, by id
+var backendHealth = cmap.New()
+
+func getBackendHealth(backend Backend) BackendHealth {
+	if v, ok := backendHealth.Get(backend.Id); ok {
+		return v.(BackendHealth)
+	}
+
+	// never checked, assume it's up
+	return BackendHealth{Backend: backend.Id, Kind: backend.Kind, Up: true}
+}
+
+// isDown is only true for backends that failed their latest healthcheck.
+func (backend Backend) isDown() bool {
+	return !getBackendHealth(backend).Up
+}
+
+func (backend Backend) checkHealth() BackendHealth {
+	health := getBackendHealth(backend)
+	health.Kind = backend.Kind
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	start := time.Now()
+	ln, err := backend.lightning()
+	if err == nil {
+		err = ln.Healthcheck(ctx)
+	}
+	now := time.Now()
+
+	health.LatencyMs = now.Sub(start).Milliseconds()
+	health.LastCheck = &now
+	health.Up = err == nil
+	if err == nil {
+		health.LastSuccess = &now
+	} else {
+		health.LastError = err.Error()
+		health.LastErrorAt = &now
+	}
+
+	backendHealth.Set(backend.Id, health)
+	return health
+}
+
+func checkBackendsHealth() {
+	var backends []Backend
+	err := pg.Select(&backends, `SELECT * FROM backend`)
+	if err != nil {
+		log.Error().Err(err).Msg("error listing backends for healthcheck")
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, backend := range backends {
+		wg.Add(1)
+		go func(backend Backend) {
+			defer wg.Done()
+			wasUp := !backend.isDown()
+			health := backend.checkHealth()
+			if !health.Up {
+				log.Warn().Str("backend", backend.Id).Str("kind", backend.Kind).
+					Str("error", health.LastError).Msg("backend is down")
+				if wasUp {
+					notifyBackendDown(backend, health)
+				}
+			}
+		}(backend)
+	}
+	wg.Wait()
+}
+
+func notifyBackendDown(backend Backend, health BackendHealth) {
+	var shops []string
+	err := pg.Select(&shops, `
+      SELECT shop FROM shop_backend WHERE backend = $1
+    `, backend.Id)
+	if err != nil {
+		log.Error().Err(err).Str("backend", backend.Id).
+			Msg("failed to get shops using backend")
+		return
+	}
+
+	for _, shop := range shops {
+		emitEvent(shop, EVENT_BACKEND_DOWN, "", health)
+	}
+}
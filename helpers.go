@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"database/sql/driver"
 	"encoding/json"
 	"errors"
@@ -34,9 +36,69 @@ func (ss DelimitedStringArray) Value() (driver.Value, error) {
 	return strings.Join(ss, "|"), nil
 }
 
+var httpClients = cmap.New()
+
+type cachedHTTPClient struct {
+	cert   string
+	client *http.Client
+}
+
+// httpClientFor returns an http client that trusts only the given cert, or
+// that doesn't check certificates at all if cert is empty (that's how we talk
+// to self-signed lnd nodes). Clients are kept per backend id so concurrent
+// calls to different nodes never share TLS settings.
+func httpClientFor(backendId string, cert string) *http.Client {
+	if backendId != "" {
+		if cached, ok := httpClients.Get(backendId); ok &&
+			cached.(cachedHTTPClient).cert == cert {
+			return cached.(cachedHTTPClient).client
+		}
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	if cert != "" {
+		caCertPool := x509.NewCertPool()
+		caCertPool.AppendCertsFromPEM([]byte(cert))
+		tlsConfig = &tls.Config{RootCAs: caCertPool}
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+
+	// the id is only empty while we're still discovering it
+	if backendId != "" {
+		httpClients.Set(backendId, cachedHTTPClient{cert, client})
+	}
+
+	return client
+}
+
 var fiatPrices = cmap.New()
 
+// FiatQuote is the price of a bitcoin in some currency, as we got it.
+type FiatQuote struct {
+	Currency string
+	Rate     float64
+	Source   string
+	Time     time.Time
+}
+
+func (q FiatQuote) SatoshisPerUnit() float64 {
+	return float64(100000000) / q.Rate
+}
+
 func getSatoshisPer(currency string) (float64, error) {
+	quote, err := getFiatQuote(currency)
+	if err != nil {
+		return 0, err
+	}
+	return quote.SatoshisPerUnit(), nil
+}
+
+func getFiatQuote(currency string) (FiatQuote, error) {
 	now := time.Now()
 
 	// first check cache
@@ -48,7 +110,7 @@ func getSatoshisPer(currency string) (float64, error) {
 		} else {
 			// use this
 			price, _ := fiatPrices.Get(currency + ":price")
-			return float64(100000000) / price.(float64), nil
+			return FiatQuote{currency, price.(float64), "kraken", time.Unix(since.(int64), 0)}, nil
 		}
 	}
 
@@ -57,19 +119,19 @@ func getSatoshisPer(currency string) (float64, error) {
 
 	resp, err := http.Get("https://api.kraken.com/0/public/Ticker?pair=XBT" + cur)
 	if err != nil {
-		return 0, err
+		return FiatQuote{}, err
 	}
 
 	defer resp.Body.Close()
 	b, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return 0, err
+		return FiatQuote{}, err
 	}
 
 	sprice := gjson.ParseBytes(b).Get("result.XXBTZ" + cur + ".c.0").String()
 	price, err := strconv.ParseFloat(sprice, 64)
 	if err != nil {
-		return 0, err
+		return FiatQuote{}, err
 	}
 
 	fiatPrices.MSet(map[string]interface{}{
@@ -77,7 +139,7 @@ func getSatoshisPer(currency string) (float64, error) {
 		currency + ":time":  now.Unix(),
 	})
 
-	return float64(100000000) / price, nil
+	return FiatQuote{currency, price, "kraken", time.Unix(now.Unix(), 0)}, nil
 }
 
 func paramsToJQVars(params map[string]string) (names []string, values []interface{}) {
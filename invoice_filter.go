@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// InvoiceFilter holds the filters shared by everything that lists invoices.
+type InvoiceFilter struct {
+	Shop     string
+	Template string
+	Status   string
+	Paid     *bool
+	From     *time.Time
+	To       *time.Time
+	MinMsat  *int64
+	MaxMsat  *int64
+	Params   json.RawMessage // jsonb containment
+}
+
+func parseInvoiceFilter(shopId string, r *http.Request) (f InvoiceFilter, err error) {
+	qs := r.URL.Query()
+	f.Shop = shopId
+	f.Template = qs.Get("template")
+	f.Status = qs.Get("status")
+
+	if v := qs.Get("paid"); v != "" {
+		paid, err := strconv.ParseBool(v)
+		if err != nil {
+			return f, errors.New("paid must be true or false")
+		}
+		f.Paid = &paid
+	}
+
+	for param, dst := range map[string]**time.Time{"from": &f.From, "to": &f.To} {
+		if v := qs.Get(param); v != "" {
+			t, err := parseDate(v)
+			if err != nil {
+				return f, errors.New(param + " must be a date or RFC3339 time")
+			}
+			*dst = &t
+		}
+	}
+
+	for param, dst := range map[string]**int64{"min_msat": &f.MinMsat, "max_msat": &f.MaxMsat} {
+		if v := qs.Get(param); v != "" {
+			msat, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return f, errors.New(param + " must be an integer")
+			}
+			*dst = &msat
+		}
+	}
+
+	if v := qs.Get("params"); v != "" {
+		var obj map[string]interface{}
+		if err := json.Unmarshal([]byte(v), &obj); err != nil {
+			return f, errors.New("params must be a JSON object")
+		}
+		f.Params = json.RawMessage(v)
+	}
+
+	return f, nil
+}
+
+func parseDate(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", v)
+}
+
+// where returns the conditions for the WHERE clause and their arguments,
+// which are numbered starting from $1.
+func (f InvoiceFilter) where() (string, []interface{}) {
+	conds := []string{}
+	args := []interface{}{}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		conds = append(conds, strings.Replace(cond, "?", "$"+strconv.Itoa(len(args)), 1))
+	}
+
+	add("shop = ?", f.Shop)
+	if f.Template != "" {
+		add("template = ?", f.Template)
+	}
+	if f.Status != "" {
+		add("status = ?", f.Status)
+	}
+	if f.Paid != nil {
+		if *f.Paid {
+			conds = append(conds, "status = 'paid'")
+		} else {
+			conds = append(conds, "status != 'paid'")
+		}
+	}
+	if f.From != nil {
+		add("creation >= ?::timestamptz", *f.From)
+	}
+	if f.To != nil {
+		add("creation < ?::timestamptz", *f.To)
+	}
+	if f.MinMsat != nil {
+		add("amount_msat >= ?", *f.MinMsat)
+	}
+	if f.MaxMsat != nil {
+		add("amount_msat <= ?", *f.MaxMsat)
+	}
+	if f.Params != nil {
+		add("params @> ?::jsonb", string(f.Params))
+	}
+
+	return strings.Join(conds, " AND "), args
+}
+
+// invoice cursors point to the last invoice of a page, in the order we list
+// them (creation DESC, hash DESC).
+
+func encodeInvoiceCursor(inv Invoice) string {
+	return base64.RawURLEncoding.EncodeToString(
+		[]byte(inv.Creation.Format(time.RFC3339Nano) + "|" + inv.Hash))
+}
+
+func decodeInvoiceCursor(cursor string) (creation time.Time, hash string, err error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return
+	}
+	parts := strings.SplitN(string(b), "|", 2)
+	if len(parts) != 2 {
+		err = errors.New("invalid cursor")
+		return
+	}
+	creation, err = time.Parse(time.RFC3339Nano, parts[0])
+	return creation, parts[1], err
+}
@@ -1,28 +1,48 @@
 package main
 
 import (
-	"bytes"
 	"crypto/rand"
 	"crypto/sha256"
+	"database/sql"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"net/http"
+	"sort"
+	"strings"
 	"time"
 
+	decodepay "github.com/fiatjaf/ln-decodepay"
 	"github.com/jmoiron/sqlx/types"
 )
 
 func NewInvoice(
-	templateId string,
-	shopId string,
+	t Template,
 	price int64,
 	params map[string]string,
 	encodedMetadata string,
+	quote *FiatQuote,
 ) (*Invoice, error) {
-	metadataHash := sha256.Sum256([]byte(encodedMetadata))
-	expirySeconds := 1800 // 30 minutes
+	shopId := t.Shop
+	hold := t.Hold
+	description := t.RenderDescription(params)
+
+	// what this was worth in the template currency, for accounting
+	var rate, fiatAmount *float64
+	var rateSource *string
+	var rateTime *time.Time
+	if quote != nil {
+		fiat := float64(price) / 1000 / quote.SatoshisPerUnit()
+		rate, fiatAmount = &quote.Rate, &fiat
+		rateSource, rateTime = &quote.Source, &quote.Time
+	}
+
+	expirySeconds := t.InvoiceExpiry
+	if expirySeconds == 0 {
+		expirySeconds = DEFAULT_INVOICE_EXPIRY
+	}
+	expiresAt := time.Now().Add(time.Duration(expirySeconds) * time.Second)
 	preimage := make([]byte, 32)
 	if _, err = io.ReadFull(rand.Reader, preimage); err != nil {
 		return nil, err
@@ -31,112 +51,447 @@ func NewInvoice(
 	hash := sha256.Sum256(preimage)
 	hashStr := hex.EncodeToString(hash[:])
 
-	backend, err := BackendFromShop(shopId)
+	backends, err := BackendsFromShop(shopId)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get backend info to generate invoice: %w", err)
 	}
 
-	bolt11, err := backend.MakeInvoice(price, metadataHash, preimage, expirySeconds)
+	// try the ones we know are down last
+	sort.SliceStable(backends, func(i, j int) bool {
+		return !backends[i].isDown() && backends[j].isDown()
+	})
+
+	// use the first backend that works
+	var backend Backend
+	var bolt11 string
+	for _, backend = range backends {
+		if hold {
+			bolt11, err = backend.MakeHoldInvoice(price, encodedMetadata, preimage, expirySeconds)
+		} else {
+			bolt11, err = backend.MakeInvoice(price, encodedMetadata, preimage, expirySeconds)
+		}
+		if err == nil {
+			break
+		}
+		log.Warn().Err(err).Str("shop", shopId).Str("backend", backend.Id).
+			Msg("failed to generate invoice, trying next backend")
+	}
 	if err != nil {
+		// keep a record of it so the shop can see what happened
+		_, dberr := pg.Exec(`
+          WITH inv AS (
+            INSERT INTO invoice
+              (hash, shop, template, params, amount_msat, bolt11, hold, status,
+               description, currency, rate, fiat_amount, rate_source, rate_time,
+               expires_at)
+            VALUES ($1, $2, $3, $4, $5, '', $6, $7, $8, $9, $10, $11, $12, $13, $14)
+            RETURNING hash, status
+          )
+          INSERT INTO invoice_transition (hash, to_status)
+          SELECT hash, status FROM inv
+        `, hashStr, shopId, t.Id, jsonParams(params), price, hold,
+			INVOICE_FAILED_TO_CREATE, description, t.Currency,
+			rate, fiatAmount, rateSource, rateTime, expiresAt)
+		if dberr != nil {
+			log.Warn().Err(dberr).Str("shop", shopId).
+				Msg("failed to record failed invoice")
+		}
+
 		return nil, fmt.Errorf("failed to generate invoice: %w", err)
 	}
 
-	jparams, _ := json.Marshal(params)
+	// some backends (like lnbits) don't take our preimage and use their own
+	decoded, err := decodepay.Decodepay(bolt11)
+	if err != nil {
+		return nil, fmt.Errorf("backend returned an invalid invoice: %w", err)
+	}
+	if decoded.PaymentHash != hashStr {
+		hashStr = decoded.PaymentHash
+		preimageStr = ""
+	}
+
 	var inv Invoice
 	err = pg.Get(&inv, `
-      INSERT INTO invoice
-        (preimage, hash, shop, template, params, amount_msat, bolt11)
-      VALUES ($1, $2, $3, $4, $5, $6, $7)
-      RETURNING `+INVOICEFIELDS+`
-    `, preimageStr, hashStr, shopId, templateId, jparams, price, bolt11)
+      WITH inv AS (
+        INSERT INTO invoice
+          (preimage, hash, shop, template, params, amount_msat, bolt11, backend, hold,
+           description, currency, rate, fiat_amount, rate_source, rate_time,
+           expires_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
+        RETURNING *
+      ), transition AS (
+        INSERT INTO invoice_transition (hash, to_status)
+        SELECT hash, status FROM inv
+      )
+      SELECT `+INVOICEFIELDS+` FROM inv
+    `, sql.NullString{String: preimageStr, Valid: preimageStr != ""},
+		hashStr, shopId, t.Id, jsonParams(params), price, bolt11, backend.Id, hold,
+		description, t.Currency, rate, fiatAmount, rateSource, rateTime, expiresAt)
 	if err != nil {
 		return nil, fmt.Errorf("failed to save invoice on database: %w", err)
 	}
 
+	go inv.sendWebhook(EVENT_INVOICE_CREATED)
 	return &inv, nil
 }
 
+func jsonParams(params map[string]string) []byte {
+	jparams, _ := json.Marshal(params)
+	return jparams
+}
+
+const (
+	INVOICE_PENDING          = "pending"
+	INVOICE_HELD             = "held"
+	INVOICE_PAID             = "paid"
+	INVOICE_EXPIRED          = "expired"
+	INVOICE_CANCELLED        = "cancelled"
+	INVOICE_FAILED_TO_CREATE = "failed_to_create"
+)
+
 type Invoice struct {
-	Hash       string         `db:"hash" json:"hash"`
-	Preimage   string         `db:"preimage" json:"preimage"`
-	Shop       string         `db:"shop" json:"shop"`
-	Template   string         `db:"template" json:"template"`
-	Params     types.JSONText `db:"params" json:"params"`
-	AmountMsat int64          `db:"amount_msat" json:"amount_msat"`
-	Bolt11     string         `db:"bolt11" json:"bolt11"`
-	Creation   time.Time      `db:"creation" json:"creation"`
-	Payment    *time.Time     `db:"payment" json:"payment"`
+	Hash        string         `db:"hash" json:"hash"`
+	Preimage    string         `db:"preimage" json:"preimage"`
+	Shop        string         `db:"shop" json:"shop"`
+	Template    string         `db:"template" json:"template"`
+	Params      types.JSONText `db:"params" json:"params"`
+	AmountMsat  int64          `db:"amount_msat" json:"amount_msat"`
+	Bolt11      string         `db:"bolt11" json:"bolt11"`
+	Description string         `db:"description" json:"description"`
+
+	// the fiat quote used when the template is not priced in satoshis
+	Currency   string     `db:"currency" json:"currency"`
+	FiatAmount *float64   `db:"fiat_amount" json:"fiat_amount"`
+	Rate       *float64   `db:"rate" json:"rate"`
+	RateSource *string    `db:"rate_source" json:"rate_source"`
+	RateTime   *time.Time `db:"rate_time" json:"rate_time"`
+
+	Creation   time.Time  `db:"creation" json:"creation"`
+	ExpiresAt  time.Time  `db:"expires_at" json:"expires_at"`
+	Payment    *time.Time `db:"payment" json:"payment"`
+	Backend    string     `db:"backend" json:"backend"`
+	Hold       bool       `db:"hold" json:"hold"`
+	Status     string     `db:"status" json:"status"`
+	StatusTime time.Time  `db:"status_changed" json:"status_changed"`
 
-	backend *Backend
+	// as reported by the backend when paid
+	AmountPaidMsat    *int64               `db:"amt_paid_msat" json:"amt_paid_msat"`
+	PreimageConfirmed *bool                `db:"preimage_confirmed" json:"preimage_confirmed"`
+	Flags             DelimitedStringArray `db:"flags" json:"flags"`
+
+	backend  *Backend
+	template *Template
 }
 
-const INVOICEFIELDS = `hash, preimage, template, shop, params, amount_msat, bolt11, creation, payment`
+const INVOICEFIELDS = `hash, coalesce(preimage, '') AS preimage, template, shop, params, amount_msat, bolt11, description, currency, fiat_amount, rate, rate_source, rate_time, creation, expires_at, payment, coalesce(backend, '') AS backend, hold, status, status_changed, amt_paid_msat, preimage_confirmed, flags`
 
-func (inv Invoice) Wait() {
+func InvoiceByHash(shopId string, hash string) (*Invoice, error) {
+	var inv Invoice
+	err := pg.Get(&inv, `
+      SELECT `+INVOICEFIELDS+`
+      FROM invoice
+      WHERE hash = $1 AND shop = $2
+    `, hash, shopId)
+	if err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
+
+func (inv *Invoice) loadTemplate() error {
+	if inv.template == nil {
+		var t Template
+		err := pg.Get(&t, `
+          SELECT `+TEMPLATEFIELDS+` FROM template WHERE id = $1 AND shop = $2
+        `, inv.Template, inv.Shop)
+		if err != nil {
+			return err
+		}
+		inv.template = &t
+	}
+	return nil
+}
+
+func (inv *Invoice) loadBackend() error {
 	if inv.backend == nil {
-		backend, err := BackendFromShop(inv.Shop)
+		backend, err := BackendById(inv.Backend)
 		if err != nil {
-			log.Error().Err(err).Msg("failed to get backend from invoice")
-			return
+			return err
 		}
 		inv.backend = backend
 	}
+	return nil
+}
+
+func (inv Invoice) Wait() {
+	if err := inv.loadBackend(); err != nil {
+		log.Error().Err(err).Msg("failed to get backend from invoice")
+		return
+	}
+
+	if inv.Hold {
+		inv.waitHeld()
+		return
+	}
 
-	paid := inv.backend.waitInvoicePaid(inv.Hash)
-	if !paid {
+	status := inv.backend.waitInvoicePaid(inv.Hash, inv.ExpiresAt)
+	if !status.Paid {
 		log.Debug().Interface("invoice", inv).
 			Msg("waited, but invoice wasn't paid")
 		return
 	}
 
-	inv.markAsPaid()
-	inv.sendWebhook()
+	if inv.markAsPaid(status) {
+		inv.sendWebhook(EVENT_INVOICE_PAID)
+	}
 }
 
 func (inv Invoice) Check() {
-	if inv.backend == nil {
-		backend, err := BackendFromShop(inv.Shop)
-		if err != nil {
-			log.Error().Err(err).Msg("failed to get backend from invoice")
-			return
-		}
-		inv.backend = backend
+	if err := inv.loadBackend(); err != nil {
+		log.Error().Err(err).Msg("failed to get backend from invoice")
+		return
 	}
 
-	paid := inv.backend.checkInvoice(inv.Hash)
-	if paid {
-		inv.markAsPaid()
-		inv.sendWebhook()
+	if inv.Hold {
+		inv.checkHeld()
+		return
+	}
+
+	status := inv.backend.checkInvoice(inv.Hash)
+	if status.Paid && inv.markAsPaid(status) {
+		inv.sendWebhook(EVENT_INVOICE_PAID)
 	}
 }
 
-func (inv Invoice) markAsPaid() {
+// transition moves the invoice to a new status if it is currently in one of
+// the given statuses and logs it. It returns false when some other call has
+// already done it, so each transition is only acted upon once.
+func (inv Invoice) transition(to string, from ...string) (bool, error) {
+	res, err := pg.Exec(`
+      WITH old AS (
+        SELECT hash, status FROM invoice
+        WHERE hash = $1 AND status = ANY(string_to_array($3, '|'))
+        FOR UPDATE
+      ), updated AS (
+        UPDATE invoice
+        SET status = $2,
+            status_changed = now(),
+            payment = CASE WHEN $2::text = 'paid' THEN now() ELSE payment END
+        FROM old
+        WHERE invoice.hash = old.hash
+        RETURNING old.status AS from_status
+      )
+      INSERT INTO invoice_transition (hash, from_status, to_status)
+      SELECT $1, from_status, $2 FROM updated
+    `, inv.Hash, to, strings.Join(from, "|"))
+	if err != nil {
+		return false, err
+	}
+
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func (inv Invoice) markAsPaid(status InvoiceStatus) bool {
+	// late payments to invoices we've expired are still payments
+	changed, err := inv.transition(INVOICE_PAID,
+		INVOICE_PENDING, INVOICE_HELD, INVOICE_EXPIRED)
+	if err != nil {
+		log.Error().Err(err).Interface("invoice", inv).
+			Msg("failed to mark invoice as paid")
+		return false
+	}
+	if changed {
+		inv.recordPayment(status)
+	}
+	return changed
+}
+
+// recordPayment saves what the backend told us about the payment and flags
+// anything that doesn't match what we asked for.
+func (inv Invoice) recordPayment(status InvoiceStatus) {
+	flags := make(DelimitedStringArray, 0, 2)
+
+	var amount *int64
+	if status.AmountPaidMsat != 0 {
+		amount = &status.AmountPaidMsat
+
+		// some backends round our amount down to satoshis, so what the payer
+		// was asked for is what is in the bolt11
+		expected := inv.AmountMsat
+		if decoded, err := decodepay.Decodepay(inv.Bolt11); err == nil {
+			expected = decoded.MSatoshi
+		}
+
+		if status.AmountPaidMsat > expected {
+			flags = append(flags, "overpaid")
+		} else if status.AmountPaidMsat < expected {
+			flags = append(flags, "underpaid")
+		}
+	}
+
+	var settledAt *time.Time
+	if !status.SettledAt.IsZero() {
+		settledAt = &status.SettledAt
+	}
+
+	var confirmed *bool
+	var learnedPreimage sql.NullString
+	if status.Preimage != "" {
+		preimage, _ := hex.DecodeString(status.Preimage)
+		hash := sha256.Sum256(preimage)
+		ok := hex.EncodeToString(hash[:]) == inv.Hash &&
+			(inv.Preimage == "" || inv.Preimage == status.Preimage)
+		confirmed = &ok
+
+		if !ok {
+			flags = append(flags, "preimage_mismatch")
+		} else if inv.Preimage == "" {
+			// the backend chose it, now we know it
+			learnedPreimage = sql.NullString{String: status.Preimage, Valid: true}
+		}
+	}
+
 	_, err := pg.Exec(`
       UPDATE invoice
-      SET payment = now()
+      SET amt_paid_msat = $2,
+          payment = coalesce($3, payment),
+          preimage = coalesce(preimage, $4),
+          preimage_confirmed = $5,
+          flags = $6
       WHERE hash = $1
-    `, inv.Hash)
+    `, inv.Hash, amount, settledAt, learnedPreimage, confirmed, flags)
 	if err != nil {
-		log.Error().Err(err).Interface("invoice", inv).
-			Msg("failed to mark invoice as paid")
+		log.Error().Err(err).Str("hash", inv.Hash).
+			Msg("failed to record payment details")
 		return
 	}
+
+	if len(flags) > 0 {
+		log.Warn().Str("hash", inv.Hash).Strs("flags", flags).
+			Interface("status", status).Msg("payment doesn't match invoice")
+	}
 }
 
-func (inv Invoice) sendWebhook() {
-	var webhook string
-	err = pg.Get(&webhook, `
-      SELECT webhook
-      FROM shop
-      WHERE shop.id = $1
-    `, inv.Shop)
-	if err == nil {
-		jinv, _ := json.Marshal(inv)
-		_, err := http.Post(webhook, "application/json", bytes.NewBuffer(jinv))
-		if err != nil {
-			log.Warn().Err(err).Str("url", webhook).Msg("webhook error")
-		} else {
-			log.Info().Str("url", webhook).Msg("webhook dispatched")
+func (inv Invoice) markAsCancelled() bool {
+	changed, err := inv.transition(INVOICE_CANCELLED, INVOICE_PENDING, INVOICE_HELD)
+	if err != nil {
+		log.Error().Err(err).Interface("invoice", inv).
+			Msg("failed to mark invoice as cancelled")
+		return false
+	}
+	return changed
+}
+
+// checkHeld returns true when the hold invoice won't change anymore.
+func (inv Invoice) checkHeld() (done bool) {
+	hold, err := inv.backend.holdInvoices()
+	if err != nil {
+		log.Error().Err(err).Str("hash", inv.Hash).Msg("can't check hold invoice")
+		return true
+	}
+
+	state, err := hold.HoldInvoiceState(inv.Hash)
+	if err != nil {
+		log.Warn().Err(err).Str("hash", inv.Hash).Msg("error checking hold invoice")
+		return false
+	}
+
+	switch state {
+	case HOLD_ACCEPTED:
+		inv.markAsHeld()
+		return true
+	case HOLD_SETTLED:
+		if inv.markAsPaid(inv.backend.checkInvoice(inv.Hash)) {
+			inv.sendWebhook(EVENT_INVOICE_PAID)
+		}
+		return true
+	case HOLD_CANCELED:
+		inv.markAsCancelled()
+		return true
+	}
+	return false
+}
+
+func (inv Invoice) waitHeld() {
+	for time.Now().Before(inv.ExpiresAt.Add(invoiceGracePeriod)) {
+		if inv.checkHeld() {
+			return
 		}
+		time.Sleep(5 * time.Second)
 	}
 }
+
+func (inv Invoice) markAsHeld() {
+	changed, err := inv.transition(INVOICE_HELD, INVOICE_PENDING)
+	if err != nil {
+		log.Error().Err(err).Interface("invoice", inv).
+			Msg("failed to mark invoice as held")
+		return
+	}
+
+	// tell the merchant they must settle or cancel
+	if changed {
+		inv.sendWebhook(EVENT_INVOICE_HELD)
+	}
+}
+
+func (inv Invoice) Settle() error {
+	if inv.Status != INVOICE_HELD {
+		return errors.New("invoice is " + inv.Status + ", not held")
+	}
+	if err := inv.loadBackend(); err != nil {
+		return err
+	}
+	hold, err := inv.backend.holdInvoices()
+	if err != nil {
+		return err
+	}
+
+	preimage, err := hex.DecodeString(inv.Preimage)
+	if err != nil {
+		return err
+	}
+	err = hold.SettleHoldInvoice(preimage)
+	if err != nil {
+		return fmt.Errorf("failed to settle: %w", err)
+	}
+
+	if inv.markAsPaid(inv.backend.checkInvoice(inv.Hash)) {
+		inv.sendWebhook(EVENT_INVOICE_PAID)
+	}
+	return nil
+}
+
+func (inv Invoice) Cancel() error {
+	if !inv.Hold {
+		return errors.New("only hold invoices can be cancelled")
+	}
+	if inv.Status != INVOICE_PENDING && inv.Status != INVOICE_HELD {
+		return errors.New("invoice is already " + inv.Status)
+	}
+	if err := inv.loadBackend(); err != nil {
+		return err
+	}
+	hold, err := inv.backend.holdInvoices()
+	if err != nil {
+		return err
+	}
+
+	err = hold.CancelHoldInvoice(inv.Hash)
+	if err != nil {
+		return fmt.Errorf("failed to cancel: %w", err)
+	}
+
+	inv.markAsCancelled()
+	return nil
+}
+
+func (inv Invoice) sendWebhook(event string) {
+	// send what we have on the database, which may have changed
+	if fresh, err := InvoiceByHash(inv.Shop, inv.Hash); err == nil {
+		inv = *fresh
+	}
+
+	emitEvent(inv.Shop, event, inv.Template, inv)
+}
@@ -53,7 +53,25 @@ func lnurlPayParams(w http.ResponseWriter, r *http.Request) {
 	log.Debug().Str("tpl", t.Id).Str("shop", t.Shop).Interface("params", params).
 		Msg("lnurl-pay 1st call")
 
-	min, max, err := t.GetPrices(params)
+	// don't let people try to pay if we already know we can't make invoices
+	backends, err := BackendsFromShop(t.Shop)
+	if err != nil {
+		json.NewEncoder(w).Encode(lnurl.ErrorResponse("Couldn't get shop backends: " + err.Error()))
+		return
+	}
+	allDown := true
+	for _, backend := range backends {
+		if !backend.isDown() {
+			allDown = false
+			break
+		}
+	}
+	if allDown {
+		json.NewEncoder(w).Encode(lnurl.ErrorResponse("This shop's lightning node is unavailable, try again later."))
+		return
+	}
+
+	min, max, _, err := t.GetPrices(params)
 	if err != nil {
 		json.NewEncoder(w).Encode(lnurl.ErrorResponse("Failed to calculate price: " + err.Error()))
 		return
@@ -101,7 +119,7 @@ func lnurlPayValues(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	go invoice.Wait()
+	watchInvoice(*invoice)
 
 	r.Header.Set("X-Invoice-Id", invoice.Hash)
 	json.NewEncoder(w).Encode(lnurl.LNURLPayResponse2{
@@ -21,6 +21,12 @@ type Settings struct {
 	ServiceURL  string `envconfig:"SERVICE_URL" required:"true"`
 	PostgresURL string `envconfig:"DATABASE_URL" required:"true"`
 	Secret      string `envconfig:"SECRET" required:"true"`
+	FakeBackend bool   `envconfig:"FAKE_BACKEND" default:"false"`
+
+	WatchersPerBackend int `envconfig:"WATCHERS_PER_BACKEND" default:"200"`
+
+	ConnectionSecret     string   `envconfig:"CONNECTION_SECRET" required:"true"`
+	OldConnectionSecrets []string `envconfig:"OLD_CONNECTION_SECRETS"`
 }
 
 var err error
@@ -33,6 +39,10 @@ func main() {
 	if err != nil {
 		log.Fatal().Err(err).Msg("couldn't process envconfig.")
 	}
+	if s.WatchersPerBackend < 1 {
+		log.Fatal().Int("n", s.WatchersPerBackend).
+			Msg("WATCHERS_PER_BACKEND must be at least 1.")
+	}
 
 	// postgres connection
 	pg, err = sqlx.Connect("postgres", s.PostgresURL)
@@ -40,6 +50,13 @@ func main() {
 		log.Fatal().Err(err).Msg("couldn't connect to postgres")
 	}
 
+	// encrypt backend secrets with the current key
+	initConnectionKeys()
+	rotateConnectionKeys()
+
+	// payments that arrived while we were down are found right away
+	resumeWatching()
+
 	// run check/cleanup tasks on start
 	// and then every 30 minutes
 	go func() {
@@ -50,6 +67,31 @@ func main() {
 		}
 	}()
 
+	// expired and hold invoices need to be looked at more often
+	go func() {
+		for {
+			expireInvoices()
+			cancelStaleHolds()
+			time.Sleep(5 * time.Minute)
+		}
+	}()
+
+	// webhooks that failed are tried again
+	go func() {
+		for {
+			retryWebhooks()
+			time.Sleep(15 * time.Second)
+		}
+	}()
+
+	// probe all backends every minute
+	go func() {
+		for {
+			checkBackendsHealth()
+			time.Sleep(1 * time.Minute)
+		}
+	}()
+
 	// files
 	indexhtml := MustAsset("public/index.html")
 
@@ -82,13 +124,30 @@ func main() {
 	apimux.Use(authMiddleware)
 	apimux.Path("/api/shop/{shop}").Methods("GET").HandlerFunc(getShop)
 	apimux.Path("/api/shop/{shop}").Methods("PUT").HandlerFunc(setShop)
+	apimux.Path("/api/shop/{shop}/webhook/secret").Methods("POST").HandlerFunc(rotateWebhookSecret)
+	apimux.Path("/api/shop/{shop}/webhooks/deliveries").Methods("GET").HandlerFunc(listWebhookDeliveries)
+	apimux.Path("/api/shop/{shop}/webhooks/deliveries/{id}").Methods("GET").HandlerFunc(getWebhookDelivery)
+	apimux.Path("/api/shop/{shop}/webhooks/deliveries/{id}/retry").Methods("POST").HandlerFunc(retryWebhookDelivery)
+	apimux.Path("/api/shop/{shop}/webhooks").Methods("GET").HandlerFunc(listWebhooks)
+	apimux.Path("/api/shop/{shop}/webhooks").Methods("POST").HandlerFunc(createWebhook)
+	apimux.Path("/api/shop/{shop}/webhooks/test").Methods("POST").HandlerFunc(testWebhook)
+	apimux.Path("/api/shop/{shop}/webhooks/{id}").Methods("PUT").HandlerFunc(updateWebhook)
+	apimux.Path("/api/shop/{shop}/webhooks/{id}").Methods("DELETE").HandlerFunc(deleteWebhook)
+	apimux.Path("/api/shop/{shop}/backend/status").Methods("GET").HandlerFunc(getBackendStatus)
 	apimux.Path("/api/shop/{shop}/templates").Methods("GET").HandlerFunc(listTemplates)
 	apimux.Path("/api/shop/{shop}/template/{tpl}").Methods("PUT").HandlerFunc(setTemplate)
 	apimux.Path("/api/shop/{shop}/template/{tpl}").Methods("DELETE").HandlerFunc(deleteTemplate)
 	apimux.Path("/api/shop/{shop}/template/{tpl}").Methods("GET").HandlerFunc(getTemplate)
 	apimux.Path("/api/shop/{shop}/template/{tpl}/lnurl").Methods("GET").HandlerFunc(getLNURL)
 	apimux.Path("/api/shop/{shop}/invoices").Methods("GET").HandlerFunc(listInvoices)
+	apimux.Path("/api/shop/{shop}/invoices/export").Methods("GET").HandlerFunc(exportInvoices)
+	apimux.Path("/api/shop/{shop}/stats").Methods("GET").HandlerFunc(getStats)
 	apimux.Path("/api/shop/{shop}/invoice/{hash}").Methods("GET").HandlerFunc(getInvoice)
+	apimux.Path("/api/shop/{shop}/invoice/{hash}/settle").Methods("POST").HandlerFunc(settleInvoice)
+	apimux.Path("/api/shop/{shop}/invoice/{hash}/cancel").Methods("POST").HandlerFunc(cancelInvoice)
+	if s.FakeBackend {
+		apimux.Path("/api/shop/{shop}/invoice/{hash}/pay").Methods("POST").HandlerFunc(payFakeInvoice)
+	}
 
 	basemux.PathPrefix("/api/").Handler(apimux)
 	basemux.PathPrefix("/lnurl/").Handler(lnurlmux)
@@ -0,0 +1,314 @@
+-- Upgrades a database made with an older postgres.sql, keeping its data:
+--   psql -U postgres -h 127.0.0.1 -d lnurlpaydb -f migrate.sql
+-- It can be run again, steps that were already done are skipped.
+
+-- more backend kinds, and invoices whose preimage the backend chose
+ALTER TABLE backend DROP CONSTRAINT IF EXISTS connection_schema;
+ALTER TABLE backend ADD CONSTRAINT connection_schema CHECK (
+  (kind = 'spark' AND (
+    jsonb_typeof(connection->'endpoint') = 'string' AND
+    jsonb_typeof(connection->'key') = 'string' AND
+    CASE WHEN connection ? 'cert'
+      THEN jsonb_typeof(connection->'cert') = 'string'
+      ELSE true
+    END
+  )) OR
+  (kind = 'lnd' AND (
+    jsonb_typeof(connection->'endpoint') = 'string' AND
+    jsonb_typeof(connection->'macaroon') = 'string' AND
+    CASE WHEN connection ? 'cert'
+      THEN jsonb_typeof(connection->'cert') = 'string'
+      ELSE true
+    END
+  )) OR
+  (kind = 'lntxbot' AND (
+    jsonb_typeof(connection->'key') = 'string'
+  )) OR
+  (kind = 'clightning' AND (
+    jsonb_typeof(connection->'path') = 'string'
+  )) OR
+  (kind = 'lnbits' AND (
+    jsonb_typeof(connection->'url') = 'string' AND
+    jsonb_typeof(connection->'key') = 'string'
+  )) OR
+  (kind = 'eclair' AND (
+    jsonb_typeof(connection->'url') = 'string' AND
+    jsonb_typeof(connection->'password') = 'string'
+  )) OR
+  (kind NOT IN ('spark', 'lnd', 'lntxbot', 'clightning', 'lnbits', 'eclair'))
+);
+ALTER TABLE invoice ALTER COLUMN preimage DROP NOT NULL;
+
+-- shop.backend becomes the first of the shop backends, and the one that made
+-- all of its invoices so far
+CREATE TABLE IF NOT EXISTS shop_backend (
+  shop text NOT NULL REFERENCES shop (id),
+  backend text NOT NULL REFERENCES backend (id),
+  position int NOT NULL,
+
+  PRIMARY KEY (shop, backend),
+  UNIQUE (shop, position)
+);
+ALTER TABLE invoice ADD COLUMN IF NOT EXISTS backend text REFERENCES backend (id);
+DO $$ BEGIN
+  IF EXISTS (
+    SELECT 1 FROM information_schema.columns
+    WHERE table_name = 'shop' AND column_name = 'backend'
+  ) THEN
+    INSERT INTO shop_backend (shop, backend, position)
+    SELECT id, backend, 0 FROM shop WHERE backend IS NOT NULL
+    ON CONFLICT DO NOTHING;
+
+    UPDATE invoice SET backend = shop.backend
+    FROM shop
+    WHERE shop.id = invoice.shop AND invoice.backend IS NULL;
+
+    ALTER TABLE shop DROP COLUMN backend;
+  END IF;
+END $$;
+
+-- encrypted secrets are longer
+ALTER TABLE backend DROP CONSTRAINT IF EXISTS connection_length;
+ALTER TABLE backend ADD CONSTRAINT connection_length CHECK (char_length(connection::text) < 5000);
+
+-- configurable lntxbot endpoint and the http kind
+ALTER TABLE backend DROP CONSTRAINT IF EXISTS connection_schema;
+ALTER TABLE backend ADD CONSTRAINT connection_schema CHECK (
+  (kind = 'spark' AND (
+    jsonb_typeof(connection->'endpoint') = 'string' AND
+    jsonb_typeof(connection->'key') = 'string' AND
+    CASE WHEN connection ? 'cert'
+      THEN jsonb_typeof(connection->'cert') = 'string'
+      ELSE true
+    END
+  )) OR
+  (kind = 'lnd' AND (
+    jsonb_typeof(connection->'endpoint') = 'string' AND
+    jsonb_typeof(connection->'macaroon') = 'string' AND
+    CASE WHEN connection ? 'cert'
+      THEN jsonb_typeof(connection->'cert') = 'string'
+      ELSE true
+    END
+  )) OR
+  (kind = 'lntxbot' AND (
+    jsonb_typeof(connection->'key') = 'string' AND
+    CASE WHEN connection ? 'endpoint'
+      THEN jsonb_typeof(connection->'endpoint') = 'string'
+      ELSE true
+    END
+  )) OR
+  (kind = 'clightning' AND (
+    jsonb_typeof(connection->'path') = 'string'
+  )) OR
+  (kind = 'lnbits' AND (
+    jsonb_typeof(connection->'url') = 'string' AND
+    jsonb_typeof(connection->'key') = 'string'
+  )) OR
+  (kind = 'eclair' AND (
+    jsonb_typeof(connection->'url') = 'string' AND
+    jsonb_typeof(connection->'password') = 'string'
+  )) OR
+  (kind = 'http' AND (
+    jsonb_typeof(connection->'create'->'url') = 'string' AND
+    jsonb_typeof(connection->'create'->'bolt11') = 'string' AND
+    jsonb_typeof(connection->'check'->'url') = 'string' AND
+    jsonb_typeof(connection->'check'->'paid') = 'string'
+  )) OR
+  (kind NOT IN ('spark', 'lnd', 'lntxbot', 'clightning', 'lnbits', 'eclair', 'http'))
+);
+
+-- lntxbot wallets share a node, so each key gets its own backend id like the
+-- other custodial kinds. keys the app has already encrypted can't be hashed
+-- here, those backends keep their id.
+DO $$ BEGIN
+  CREATE TEMPORARY TABLE lntxbot_rekey ON COMMIT DROP AS
+  SELECT id AS old_id,
+         id || ':' || substr(encode(sha256(convert_to(
+           regexp_replace(
+             coalesce(nullif(connection->>'endpoint', ''), 'https://lntxbot.bigsun.xyz'),
+             '/$', ''
+           ) || '/' || (connection->>'key'),
+         'UTF8')), 'hex'), 1, 16) AS new_id
+  FROM backend
+  WHERE kind = 'lntxbot' AND position(':' in id) = 0
+    AND connection->>'key' NOT LIKE 'enc:%';
+
+  INSERT INTO backend (id, kind, connection)
+  SELECT new_id, kind, connection
+  FROM backend INNER JOIN lntxbot_rekey ON backend.id = old_id
+  ON CONFLICT (id) DO NOTHING;
+
+  UPDATE shop_backend SET backend = new_id
+  FROM lntxbot_rekey WHERE backend = old_id;
+  UPDATE invoice SET backend = new_id
+  FROM lntxbot_rekey WHERE backend = old_id;
+
+  DELETE FROM backend USING lntxbot_rekey WHERE id = old_id;
+END $$;
+
+-- hold invoices
+ALTER TABLE template ADD COLUMN IF NOT EXISTS hold boolean NOT NULL DEFAULT false;
+ALTER TABLE invoice ADD COLUMN IF NOT EXISTS hold boolean NOT NULL DEFAULT false;
+
+-- invoice status and its transitions log, replacing held and cancelled
+ALTER TABLE invoice ALTER COLUMN backend DROP NOT NULL;
+ALTER TABLE invoice ADD COLUMN IF NOT EXISTS status text NOT NULL DEFAULT 'pending';
+ALTER TABLE invoice ADD COLUMN IF NOT EXISTS status_changed timestamp NOT NULL DEFAULT now();
+ALTER TABLE invoice DROP CONSTRAINT IF EXISTS status_value;
+ALTER TABLE invoice ADD CONSTRAINT status_value CHECK (
+  status IN ('pending', 'held', 'paid', 'expired', 'cancelled', 'failed_to_create')
+);
+CREATE INDEX IF NOT EXISTS invoice_status_idx ON invoice (status);
+
+CREATE TABLE IF NOT EXISTS invoice_transition (
+  hash text NOT NULL REFERENCES invoice (hash),
+  from_status text, -- null when the invoice was created
+  to_status text NOT NULL,
+  time timestamp NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS invoice_transition_hash_idx ON invoice_transition (hash);
+
+-- invoices made before there was a status get it from what we knew about them,
+-- hold invoices also from the held and cancelled times
+DO $$
+DECLARE
+  had_held boolean := EXISTS (
+    SELECT 1 FROM information_schema.columns
+    WHERE table_name = 'invoice' AND column_name = 'held'
+  );
+BEGIN
+  IF NOT EXISTS (SELECT 1 FROM invoice_transition) THEN
+    UPDATE invoice SET status = 'paid', status_changed = payment
+    WHERE payment IS NOT NULL;
+
+    IF had_held THEN
+      UPDATE invoice SET status = 'cancelled', status_changed = cancelled
+      WHERE payment IS NULL AND cancelled IS NOT NULL;
+      UPDATE invoice SET status = 'held', status_changed = held
+      WHERE payment IS NULL AND cancelled IS NULL AND held IS NOT NULL;
+    END IF;
+
+    INSERT INTO invoice_transition (hash, from_status, to_status, time)
+    SELECT hash, null, 'pending', creation FROM invoice;
+    INSERT INTO invoice_transition (hash, from_status, to_status, time)
+    SELECT hash, 'pending', status, status_changed FROM invoice
+    WHERE status != 'pending';
+  END IF;
+
+  IF had_held THEN
+    ALTER TABLE invoice DROP COLUMN held;
+    ALTER TABLE invoice DROP COLUMN cancelled;
+  END IF;
+END $$;
+
+-- payment details reported by the backends
+ALTER TABLE invoice ADD COLUMN IF NOT EXISTS amt_paid_msat numeric(13);
+ALTER TABLE invoice ADD COLUMN IF NOT EXISTS preimage_confirmed boolean;
+ALTER TABLE invoice ADD COLUMN IF NOT EXISTS flags text NOT NULL DEFAULT '';
+
+-- invoice listing pages
+CREATE INDEX IF NOT EXISTS invoice_shop_creation_hash_idx ON invoice (shop, creation DESC, hash DESC);
+
+-- invoice description and currency for exports
+ALTER TABLE invoice ADD COLUMN IF NOT EXISTS description text NOT NULL DEFAULT '';
+ALTER TABLE invoice ADD COLUMN IF NOT EXISTS currency text;
+UPDATE invoice SET currency = template.currency
+FROM template
+WHERE invoice.currency IS NULL
+  AND template.shop = invoice.shop AND template.id = invoice.template;
+ALTER TABLE invoice ALTER COLUMN currency SET DEFAULT 'sat';
+UPDATE invoice SET currency = 'sat' WHERE currency IS NULL;
+ALTER TABLE invoice ALTER COLUMN currency SET NOT NULL;
+ALTER TABLE invoice ADD COLUMN IF NOT EXISTS rate numeric;
+
+-- the rest of the fiat quote
+ALTER TABLE invoice ADD COLUMN IF NOT EXISTS fiat_amount numeric;
+ALTER TABLE invoice ADD COLUMN IF NOT EXISTS rate_source text;
+ALTER TABLE invoice ADD COLUMN IF NOT EXISTS rate_time timestamp;
+
+-- sales statistics
+CREATE INDEX IF NOT EXISTS invoice_shop_template_creation_idx ON invoice (shop, template, creation);
+
+-- invoice expiry and retention
+ALTER TABLE shop ADD COLUMN IF NOT EXISTS retention_days int;
+ALTER TABLE template ADD COLUMN IF NOT EXISTS invoice_expiry int NOT NULL DEFAULT 1800;
+ALTER TABLE template DROP CONSTRAINT IF EXISTS invoice_expiry_range;
+ALTER TABLE template ADD CONSTRAINT invoice_expiry_range CHECK (invoice_expiry BETWEEN 60 AND 604800);
+ALTER TABLE invoice ADD COLUMN IF NOT EXISTS expires_at timestamp;
+UPDATE invoice SET expires_at = creation + interval '1800 seconds' WHERE expires_at IS NULL;
+ALTER TABLE invoice ALTER COLUMN expires_at SET NOT NULL;
+
+-- webhook signing secrets, a new one for each shop
+ALTER TABLE shop ADD COLUMN IF NOT EXISTS webhook_secret text;
+UPDATE shop
+SET webhook_secret = 'whsec_' || replace(gen_random_uuid()::text || gen_random_uuid()::text, '-', '')
+WHERE webhook_secret IS NULL;
+ALTER TABLE shop ALTER COLUMN webhook_secret SET NOT NULL;
+ALTER TABLE shop ADD COLUMN IF NOT EXISTS webhook_secret_old text;
+ALTER TABLE shop ADD COLUMN IF NOT EXISTS webhook_secret_rotated timestamp;
+
+-- webhook deliveries and their attempts
+CREATE TABLE IF NOT EXISTS webhook_delivery (
+  id text PRIMARY KEY,
+  event_id text NOT NULL, -- the same for all attempts
+  event text NOT NULL,
+  shop text NOT NULL REFERENCES shop (id),
+  url text NOT NULL,
+  body jsonb NOT NULL,
+  status text NOT NULL DEFAULT 'pending', -- pending, delivered or failed
+  attempts int NOT NULL DEFAULT 0,
+  created timestamp NOT NULL DEFAULT now(),
+  next_attempt timestamp DEFAULT now(), -- null when not pending
+  delivered timestamp,
+
+  CONSTRAINT status_value CHECK (status IN ('pending', 'delivered', 'failed'))
+);
+CREATE INDEX IF NOT EXISTS webhook_delivery_shop_created_idx ON webhook_delivery (shop, created DESC);
+CREATE INDEX IF NOT EXISTS webhook_delivery_next_attempt_idx ON webhook_delivery (next_attempt)
+WHERE status = 'pending';
+
+CREATE TABLE IF NOT EXISTS webhook_attempt (
+  delivery text NOT NULL REFERENCES webhook_delivery (id),
+  time timestamp NOT NULL DEFAULT now(),
+  status_code int NOT NULL, -- 0 when there was no response
+  latency_ms int NOT NULL,
+  response text NOT NULL, -- the start of the response body
+  error text NOT NULL
+);
+CREATE INDEX IF NOT EXISTS webhook_attempt_delivery_idx ON webhook_attempt (delivery);
+
+-- shop.webhook becomes the first webhook endpoint of the shop, getting the
+-- events it used to get
+CREATE TABLE IF NOT EXISTS webhook (
+  id text PRIMARY KEY,
+  shop text NOT NULL REFERENCES shop (id),
+  url text NOT NULL,
+  events text[] NOT NULL,
+  template text, -- only send events about this template, null sends all
+  created timestamp NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS webhook_shop_idx ON webhook (shop);
+
+DO $$
+BEGIN
+  IF EXISTS (
+    SELECT 1 FROM information_schema.columns
+    WHERE table_name = 'shop' AND column_name = 'webhook'
+  ) THEN
+    INSERT INTO webhook (id, shop, url, events)
+    SELECT 'wh_' || substr(replace(gen_random_uuid()::text, '-', ''), 1, 16), id, webhook,
+           ARRAY['invoice.paid', 'invoice.held']
+    FROM shop
+    WHERE webhook IS NOT NULL AND webhook != '';
+
+    ALTER TABLE shop DROP COLUMN webhook;
+  END IF;
+END $$;
+
+ALTER TABLE webhook_delivery ADD COLUMN IF NOT EXISTS webhook text
+REFERENCES webhook (id) ON DELETE SET NULL;
+
+-- versioned webhook events, existing shops start on the first version
+ALTER TABLE shop ADD COLUMN IF NOT EXISTS api_version text;
+UPDATE shop SET api_version = '2026-10-18' WHERE api_version IS NULL;
+ALTER TABLE shop ALTER COLUMN api_version SET NOT NULL;
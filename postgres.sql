@@ -1,9 +1,10 @@
 CREATE TABLE backend (
-  id text PRIMARY KEY, -- the node id
-  kind text NOT NULL, -- spark, lnd, lntxbot etc.
+  id text PRIMARY KEY, -- the node id (plus a wallet suffix for custodial kinds)
+  kind text NOT NULL, -- spark, lnd, lntxbot, clightning, lnbits, eclair, http etc.
   connection jsonb NOT NULL,
 
-  CONSTRAINT connection_length CHECK (char_length(connection::text) < 2000),
+  -- secret fields are encrypted by the app, see secrets.go
+  CONSTRAINT connection_length CHECK (char_length(connection::text) < 5000),
   CONSTRAINT connection_schema CHECK (
     (kind = 'spark' AND (
       jsonb_typeof(connection->'endpoint') = 'string' AND
@@ -22,17 +23,43 @@ CREATE TABLE backend (
       END
     )) OR
     (kind = 'lntxbot' AND (
+      jsonb_typeof(connection->'key') = 'string' AND
+      CASE WHEN connection ? 'endpoint'
+        THEN jsonb_typeof(connection->'endpoint') = 'string'
+        ELSE true
+      END
+    )) OR
+    (kind = 'clightning' AND (
+      jsonb_typeof(connection->'path') = 'string'
+    )) OR
+    (kind = 'lnbits' AND (
+      jsonb_typeof(connection->'url') = 'string' AND
       jsonb_typeof(connection->'key') = 'string'
-    ))
+    )) OR
+    (kind = 'eclair' AND (
+      jsonb_typeof(connection->'url') = 'string' AND
+      jsonb_typeof(connection->'password') = 'string'
+    )) OR
+    (kind = 'http' AND (
+      jsonb_typeof(connection->'create'->'url') = 'string' AND
+      jsonb_typeof(connection->'create'->'bolt11') = 'string' AND
+      jsonb_typeof(connection->'check'->'url') = 'string' AND
+      jsonb_typeof(connection->'check'->'paid') = 'string'
+    )) OR
+    -- other kinds are checked by the validator they register in Go
+    (kind NOT IN ('spark', 'lnd', 'lntxbot', 'clightning', 'lnbits', 'eclair', 'http'))
   )
 );
 
 CREATE TABLE shop (
   id text PRIMARY KEY,
-  backend text REFERENCES backend (id),
   key text NOT NULL DEFAULT md5(random()::text),
   message text,
-  webhook text,
+  retention_days int, -- unpaid invoices are deleted after this, null keeps them
+  webhook_secret text NOT NULL, -- signs webhooks
+  webhook_secret_old text, -- still used to sign for a day after a rotation
+  webhook_secret_rotated timestamp,
+  api_version text NOT NULL, -- of the webhook events
 
   -- {"kind": "none"}
   -- {"kind": "sequential", "init": 0, "words": ["pluc", "plec", "plic"]})
@@ -58,6 +85,16 @@ CREATE TABLE shop (
 
 CREATE INDEX ON shop (key);
 
+-- invoices are made on the first backend that works, in order of position
+CREATE TABLE shop_backend (
+  shop text NOT NULL REFERENCES shop (id),
+  backend text NOT NULL REFERENCES backend (id),
+  position int NOT NULL,
+
+  PRIMARY KEY (shop, backend),
+  UNIQUE (shop, position)
+);
+
 CREATE TABLE template (
   id text NOT NULL,
   shop text NOT NULL REFERENCES shop (id),
@@ -68,8 +105,11 @@ CREATE TABLE template (
   currency text NOT NULL DEFAULT 'sat', -- sat, usd, eur, brl etc.
   min_price text NOT NULL, -- formula
   max_price text NOT NULL, -- formula
+  hold boolean NOT NULL DEFAULT false, -- payments wait for the merchant to settle
+  invoice_expiry int NOT NULL DEFAULT 1800, -- seconds
 
   PRIMARY KEY (shop, id),
+  CONSTRAINT invoice_expiry_range CHECK (invoice_expiry BETWEEN 60 AND 604800),
   CONSTRAINT params_overlap CHECK (not (path_params && query_params)),
   CONSTRAINT currency_check CHECK (
     currency IN ('sat', 'eur', 'usd', 'gbp', 'cad', 'jpy')
@@ -91,14 +131,94 @@ CREATE TABLE template (
 
 CREATE TABLE invoice (
   hash text PRIMARY KEY,
-  preimage text UNIQUE NOT NULL,
+  preimage text UNIQUE, -- null when the backend chose it and we don't know it yet
   shop text NOT NULL,
   template text NOT NULL,
   params jsonb NOT NULL,
   creation timestamp NOT NULL DEFAULT now(),
-  payment timestamp, -- null when not paid
+  expires_at timestamp NOT NULL,
+  payment timestamp, -- null when not paid, settlement time reported by the node if known
   amount_msat numeric(13) NOT NULL,
   bolt11 text NOT NULL,
+  description text NOT NULL DEFAULT '', -- as rendered from the template
+  -- the fiat quote, null for templates priced in satoshis
+  currency text NOT NULL DEFAULT 'sat', -- the template currency
+  fiat_amount numeric, -- amount_msat in that currency
+  rate numeric, -- price of 1 BTC in that currency when the invoice was made
+  rate_source text, -- where we got the rate from
+  rate_time timestamp, -- when we got it
+  backend text REFERENCES backend (id), -- the one that made the invoice, null if none could
+  hold boolean NOT NULL DEFAULT false,
+
+  -- pending -> paid | expired | cancelled
+  -- pending -> held -> paid | cancelled (hold invoices)
+  -- expired -> paid (late payments)
+  -- failed_to_create when no backend could make the invoice
+  status text NOT NULL DEFAULT 'pending',
+  status_changed timestamp NOT NULL DEFAULT now(),
 
+  -- payment details reported by the backend, null when it doesn't tell us
+  amt_paid_msat numeric(13),
+  preimage_confirmed boolean, -- the preimage reported matches the hash
+  flags text NOT NULL DEFAULT '', -- |-separated: overpaid, underpaid, preimage_mismatch
+
+  CONSTRAINT status_value CHECK (
+    status IN ('pending', 'held', 'paid', 'expired', 'cancelled', 'failed_to_create')
+  ),
   FOREIGN KEY (shop, template) REFERENCES template (shop, id)
 );
+
+CREATE INDEX ON invoice (status);
+CREATE INDEX ON invoice (shop, creation DESC, hash DESC);
+CREATE INDEX ON invoice (shop, template, creation);
+
+CREATE TABLE invoice_transition (
+  hash text NOT NULL REFERENCES invoice (hash),
+  from_status text, -- null when the invoice was created
+  to_status text NOT NULL,
+  time timestamp NOT NULL DEFAULT now()
+);
+
+CREATE INDEX ON invoice_transition (hash);
+
+CREATE TABLE webhook (
+  id text PRIMARY KEY,
+  shop text NOT NULL REFERENCES shop (id),
+  url text NOT NULL,
+  events text[] NOT NULL,
+  template text, -- only send events about this template, null sends all
+  created timestamp NOT NULL DEFAULT now()
+);
+
+CREATE INDEX ON webhook (shop);
+
+CREATE TABLE webhook_delivery (
+  id text PRIMARY KEY,
+  webhook text REFERENCES webhook (id) ON DELETE SET NULL,
+  event_id text NOT NULL, -- the same for all attempts
+  event text NOT NULL,
+  shop text NOT NULL REFERENCES shop (id),
+  url text NOT NULL,
+  body jsonb NOT NULL,
+  status text NOT NULL DEFAULT 'pending', -- pending, delivered or failed
+  attempts int NOT NULL DEFAULT 0,
+  created timestamp NOT NULL DEFAULT now(),
+  next_attempt timestamp DEFAULT now(), -- null when not pending
+  delivered timestamp,
+
+  CONSTRAINT status_value CHECK (status IN ('pending', 'delivered', 'failed'))
+);
+
+CREATE INDEX ON webhook_delivery (shop, created DESC);
+CREATE INDEX ON webhook_delivery (next_attempt) WHERE status = 'pending';
+
+CREATE TABLE webhook_attempt (
+  delivery text NOT NULL REFERENCES webhook_delivery (id),
+  time timestamp NOT NULL DEFAULT now(),
+  status_code int NOT NULL, -- 0 when there was no response
+  latency_ms int NOT NULL,
+  response text NOT NULL, -- the start of the response body
+  error text NOT NULL
+);
+
+CREATE INDEX ON webhook_attempt (delivery);
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// Secret fields in backend connections are stored with envelope encryption:
+// each value is encrypted with its own random data key, and that key is
+// encrypted with a key derived from CONNECTION_SECRET. Sealed values look like
+//
+//   enc:<key id>:<base64 encrypted data key>:<base64 encrypted value>
+//
+// Rotating means setting a new CONNECTION_SECRET and moving the old one to
+// OLD_CONNECTION_SECRETS, then on start we re-encrypt all data keys.
+
+type connectionKey struct {
+	id  string
+	key []byte
+}
+
+// the first one is the current
+var connectionKeys []connectionKey
+
+func initConnectionKeys() {
+	connectionKeys = nil
+	for _, secret := range append([]string{s.ConnectionSecret}, s.OldConnectionSecrets...) {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte("lnurlpayserver/connection"))
+		key := mac.Sum(nil)
+		id := sha256.Sum256(key)
+		connectionKeys = append(connectionKeys, connectionKey{
+			id:  hex.EncodeToString(id[:4]),
+			key: key,
+		})
+	}
+}
+
+func findConnectionKey(id string) (connectionKey, error) {
+	for _, ck := range connectionKeys {
+		if ck.id == id {
+			return ck, nil
+		}
+	}
+	return connectionKey{}, errors.New("unknown connection key " + id)
+}
+
+func isSealed(value string) bool {
+	return strings.HasPrefix(value, "enc:")
+}
+
+func sealSecret(plain string) (string, error) {
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", err
+	}
+
+	sealedValue, err := gcmSeal(dataKey, []byte(plain))
+	if err != nil {
+		return "", err
+	}
+
+	return wrapDataKey(dataKey, sealedValue)
+}
+
+func wrapDataKey(dataKey []byte, sealedValue []byte) (string, error) {
+	current := connectionKeys[0]
+	sealedKey, err := gcmSeal(current.key, dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	return "enc:" + current.id + ":" +
+		base64.StdEncoding.EncodeToString(sealedKey) + ":" +
+		base64.StdEncoding.EncodeToString(sealedValue), nil
+}
+
+func unwrapDataKey(sealed string) (dataKey []byte, sealedValue []byte, keyId string, err error) {
+	parts := strings.Split(sealed, ":")
+	if len(parts) != 4 || parts[0] != "enc" {
+		return nil, nil, "", errors.New("malformed sealed value")
+	}
+	keyId = parts[1]
+
+	ck, err := findConnectionKey(keyId)
+	if err != nil {
+		return nil, nil, keyId, err
+	}
+	sealedKey, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, nil, keyId, err
+	}
+	sealedValue, err = base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return nil, nil, keyId, err
+	}
+
+	dataKey, err = gcmOpen(ck.key, sealedKey)
+	return dataKey, sealedValue, keyId, err
+}
+
+func openSecret(sealed string) (string, error) {
+	if !isSealed(sealed) {
+		// stored before we started encrypting
+		return sealed, nil
+	}
+
+	dataKey, sealedValue, _, err := unwrapDataKey(sealed)
+	if err != nil {
+		return "", err
+	}
+
+	plain, err := gcmOpen(dataKey, sealedValue)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// resealSecret makes sure the value is encrypted with the current key. Only
+// the data key is re-encrypted when rotating.
+func resealSecret(value string) (resealed string, changed bool, err error) {
+	if !isSealed(value) {
+		resealed, err = sealSecret(value)
+		return resealed, true, err
+	}
+
+	dataKey, sealedValue, keyId, err := unwrapDataKey(value)
+	if err != nil {
+		return "", false, err
+	}
+	if keyId == connectionKeys[0].id {
+		return value, false, nil
+	}
+
+	resealed, err = wrapDataKey(dataKey, sealedValue)
+	return resealed, true, err
+}
+
+func gcmSeal(key []byte, plain []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plain, nil), nil
+}
+
+func gcmOpen(key []byte, sealed []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("sealed value too short")
+	}
+	nonce := sealed[:gcm.NonceSize()]
+	return gcm.Open(nil, nonce, sealed[gcm.NonceSize():], nil)
+}
+
+// mapSecrets replaces every secret field in a connection.
+func mapSecrets(
+	kind string,
+	connection []byte,
+	fn func(value string) (string, error),
+) (string, error) {
+	conn := string(connection)
+	for _, key := range backendKinds[kind].Secrets {
+		v := gjson.Get(conn, key)
+		if v.Type != gjson.String {
+			continue
+		}
+
+		replaced, err := fn(v.Str)
+		if err != nil {
+			return "", err
+		}
+		conn, _ = sjson.Set(conn, key, replaced)
+	}
+	return conn, nil
+}
+
+// rotateConnectionKeys encrypts all backend connection secrets with the
+// current key, including those that were stored in plaintext before.
+func rotateConnectionKeys() {
+	var backends []Backend
+	err := pg.Select(&backends, `SELECT * FROM backend`)
+	if err != nil {
+		log.Error().Err(err).Msg("error listing backends for key rotation")
+		return
+	}
+
+	for _, backend := range backends {
+		changed := false
+		conn, err := mapSecrets(backend.Kind, backend.Connection,
+			func(value string) (string, error) {
+				resealed, ch, err := resealSecret(value)
+				changed = changed || ch
+				return resealed, err
+			})
+		if err != nil {
+			log.Error().Err(err).Str("backend", backend.Id).
+				Msg("can't reseal backend connection")
+			continue
+		}
+		if !changed {
+			continue
+		}
+
+		_, err = pg.Exec(`
+          UPDATE backend SET connection = $2 WHERE id = $1
+        `, backend.Id, conn)
+		if err != nil {
+			log.Error().Err(err).Str("backend", backend.Id).
+				Msg("failed to save resealed backend connection")
+			continue
+		}
+		log.Info().Str("backend", backend.Id).Msg("resealed backend connection")
+	}
+}
@@ -17,21 +17,30 @@ import (
 )
 
 type Shop struct {
-	Id           string         `db:"id" json:"id"`
-	Backend      string         `db:"backend" json:"backend"`
-	Key          string         `db:"key" json:"key"`
-	Message      string         `db:"message" json:"message,omitempty"`
-	Verification types.JSONText `db:"verification" json:"verification"`
-	Webhook      string         `db:"webhook" json:"webhook"`
+	Id           string               `db:"id" json:"id"`
+	Backends     DelimitedStringArray `db:"backends" json:"backends"`
+	Key          string               `db:"key" json:"key"`
+	Message      string               `db:"message" json:"message,omitempty"`
+	Verification types.JSONText       `db:"verification" json:"verification"`
+
+	// unpaid invoices are deleted after this, null keeps them forever
+	RetentionDays *int `db:"retention_days" json:"retention_days"`
+
+	WebhookSecret        string     `db:"webhook_secret" json:"webhook_secret"`
+	OldWebhookSecret     string     `db:"webhook_secret_old" json:"-"`
+	WebhookSecretRotated *time.Time `db:"webhook_secret_rotated" json:"webhook_secret_rotated,omitempty"`
+
+	// the shape of webhook events, new shops get the latest
+	ApiVersion string `db:"api_version" json:"api_version"`
 }
 
-var SHOPFIELDS = `id, backend, key, coalesce(message, '') AS message, verification, coalesce(webhook, '') AS webhook`
+var SHOPFIELDS = `id, coalesce((SELECT string_agg(backend, '|' ORDER BY position) FROM shop_backend WHERE shop_backend.shop = shop.id), '') AS backends, key, coalesce(message, '') AS message, verification, retention_days, webhook_secret, coalesce(webhook_secret_old, '') AS webhook_secret_old, webhook_secret_rotated, api_version`
 
 func (shop *Shop) MakeSuccessAction(
 	params map[string]string,
-	invoice string,
+	preimage string,
 ) (sa *lnurl.SuccessAction, err error) {
-	key, err := hex.DecodeString(invoice)
+	key, err := hex.DecodeString(preimage)
 	if err != nil {
 		return
 	}
@@ -41,8 +50,15 @@ func (shop *Shop) MakeSuccessAction(
 	}
 
 	v := gjson.ParseBytes(shop.Verification)
+	kind := v.Get("kind").String()
+
+	if len(key) == 0 && kind != "none" {
+		// we can only encrypt the code if we know the preimage
+		return nil, errors.New("this shop's backend doesn't support " +
+			kind + " verification")
+	}
 
-	switch v.Get("kind").String() {
+	switch kind {
 	case "none":
 		if message != "" {
 			return lnurl.Action(message, ""), nil
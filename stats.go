@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type StatsRow struct {
+	Time       time.Time `db:"time" json:"time"`
+	Template   string    `db:"template" json:"template"`
+	Currency   string    `db:"currency" json:"currency"`
+	Invoices   int64     `db:"invoices" json:"invoices"`
+	Paid       int64     `db:"paid" json:"paid"`
+	PaidMsat   int64     `db:"paid_msat" json:"paid_msat"`
+	PaidFiat   float64   `db:"paid_fiat" json:"paid_fiat"`
+	Conversion float64   `db:"-" json:"conversion"`
+}
+
+// getStats returns sales grouped by template and currency in buckets of
+// invoice creation time (hour, day or month) in the given timezone. It
+// takes the same filters as listInvoices.
+func getStats(w http.ResponseWriter, r *http.Request) {
+	shop := r.Context().Value("shop").(*Shop)
+
+	bucket := r.URL.Query().Get("bucket")
+	if bucket == "" {
+		bucket = "day"
+	}
+	if bucket != "hour" && bucket != "day" && bucket != "month" {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(Response{false, "bucket must be hour, day or month"})
+		return
+	}
+
+	tz := r.URL.Query().Get("tz")
+	if tz == "" {
+		tz = "UTC"
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(Response{false, "unknown timezone " + tz})
+		return
+	}
+
+	filter, err := parseInvoiceFilter(shop.Id, r)
+	if err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(Response{false, err.Error()})
+		return
+	}
+	where, args := filter.where()
+	args = append(args, tz)
+	tzArg := "$" + strconv.Itoa(len(args))
+
+	// creation is stored in the database timezone, we convert it to the
+	// requested one before truncating and then back to an absolute time
+	stats := make([]StatsRow, 0)
+	err = pg.Select(&stats, `
+      SELECT date_trunc('`+bucket+`',
+               creation AT TIME ZONE current_setting('TimeZone') AT TIME ZONE `+tzArg+`
+             ) AT TIME ZONE `+tzArg+` AS time,
+             template,
+             currency,
+             count(*) AS invoices,
+             count(*) FILTER (WHERE status = 'paid') AS paid,
+             coalesce(sum(coalesce(amt_paid_msat, amount_msat))
+               FILTER (WHERE status = 'paid'), 0) AS paid_msat,
+             coalesce(sum(fiat_amount) FILTER (WHERE status = 'paid'), 0) AS paid_fiat
+      FROM invoice
+      WHERE `+where+` AND status != 'failed_to_create'
+      GROUP BY 1, template, currency
+      ORDER BY 1, template, currency
+    `, args...)
+	if err != nil {
+		json.NewEncoder(w).Encode(Response{false, err.Error()})
+		return
+	}
+
+	for i := range stats {
+		// so buckets are shown with the offset of the requested timezone
+		stats[i].Time = stats[i].Time.In(loc)
+		if stats[i].Invoices > 0 {
+			stats[i].Conversion = float64(stats[i].Paid) / float64(stats[i].Invoices)
+		}
+	}
+
+	json.NewEncoder(w).Encode(struct {
+		Bucket string     `json:"bucket"`
+		TZ     string     `json:"tz"`
+		Stats  []StatsRow `json:"stats"`
+	}{bucket, tz, stats})
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	cmap "github.com/orcaman/concurrent-map"
+)
+
+var invoiceSubscriptions = cmap.New()
+
+// invoiceSubscription keeps a single long-lived connection to a node that
+// tells us about paid invoices and wakes whoever is waiting on each of them.
+// The connection is only kept open while there is someone waiting.
+type invoiceSubscription struct {
+	sync.Mutex
+	key     string
+	waiters map[string][]chan struct{}
+	running bool
+	cancel  context.CancelFunc
+
+	// listen must block for as long as the connection is up, calling
+	// notify(hash) on every payment it sees.
+	listen func(ctx context.Context, sub *invoiceSubscription) error
+}
+
+func subscriptionFor(
+	key string,
+	listen func(ctx context.Context, sub *invoiceSubscription) error,
+) *invoiceSubscription {
+	invoiceSubscriptions.SetIfAbsent(key, &invoiceSubscription{
+		key:     key,
+		waiters: make(map[string][]chan struct{}),
+	})
+	v, _ := invoiceSubscriptions.Get(key)
+	sub := v.(*invoiceSubscription)
+
+	// always use the latest connection details on the next reconnect
+	sub.Lock()
+	sub.listen = listen
+	sub.Unlock()
+
+	return sub
+}
+
+// wait returns a channel that is woken whenever the given invoice may have
+// changed, so the caller should check it again. done must be called after.
+func (sub *invoiceSubscription) wait(hash string) (wake <-chan struct{}, done func()) {
+	ch := make(chan struct{}, 1)
+
+	sub.Lock()
+	sub.waiters[hash] = append(sub.waiters[hash], ch)
+	if !sub.running {
+		sub.running = true
+		go sub.run()
+	}
+	sub.Unlock()
+
+	return ch, func() {
+		sub.Lock()
+		defer sub.Unlock()
+
+		chans := sub.waiters[hash]
+		for i, c := range chans {
+			if c == ch {
+				chans = append(chans[:i], chans[i+1:]...)
+				break
+			}
+		}
+		if len(chans) == 0 {
+			delete(sub.waiters, hash)
+		} else {
+			sub.waiters[hash] = chans
+		}
+
+		if len(sub.waiters) == 0 && sub.cancel != nil {
+			sub.cancel()
+		}
+	}
+}
+
+func (sub *invoiceSubscription) notify(hash string) {
+	sub.Lock()
+	defer sub.Unlock()
+
+	for _, ch := range sub.waiters[hash] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// resync wakes everybody, to be called after a reconnection when we may
+// have missed some notifications.
+func (sub *invoiceSubscription) resync() {
+	sub.Lock()
+	defer sub.Unlock()
+
+	for _, chans := range sub.waiters {
+		for _, ch := range chans {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+func (sub *invoiceSubscription) run() {
+	logger := log.With().Str("subscription", sub.key).Logger()
+	backoff := time.Second
+
+	for {
+		sub.Lock()
+		if len(sub.waiters) == 0 {
+			sub.running = false
+			sub.cancel = nil
+			sub.Unlock()
+			return
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		sub.cancel = cancel
+		listen := sub.listen
+		sub.Unlock()
+
+		start := time.Now()
+		err := listen(ctx, sub)
+		stopped := ctx.Err() != nil
+		cancel()
+		if stopped {
+			// nobody is waiting anymore
+			continue
+		}
+
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+		logger.Warn().Err(err).Dur("backoff", backoff).
+			Msg("invoice subscription dropped, reconnecting")
+		time.Sleep(backoff)
+		if backoff < time.Minute*2 {
+			backoff *= 2
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	cmap "github.com/orcaman/concurrent-map"
+)
+
+// the invoices we are currently waiting on, by hash. invoices still waiting
+// for a slot are not in here, so checkOldInvoices keeps checking them.
+var watching = cmap.New()
+
+// a semaphore for each backend, so a shop with many open invoices doesn't
+// open too many connections to its node
+var backendWatchSlots = cmap.New()
+
+// watchInvoice waits for the invoice to be paid in the background once its
+// backend has a free slot, unless someone is already doing it by then.
+func watchInvoice(inv Invoice) {
+	if watching.Has(inv.Hash) {
+		return
+	}
+
+	backendWatchSlots.SetIfAbsent(inv.Backend, make(chan struct{}, s.WatchersPerBackend))
+	v, _ := backendWatchSlots.Get(inv.Backend)
+	slots := v.(chan struct{})
+
+	go func() {
+		slots <- struct{}{}
+		defer func() { <-slots }()
+
+		if !watching.SetIfAbsent(inv.Hash, struct{}{}) {
+			return
+		}
+		defer watching.Remove(inv.Hash)
+
+		inv.Wait()
+	}()
+}
+
+// resumeWatching starts waiting again on all the invoices that were still
+// open when we last stopped. The database is the registry of pending
+// invoices, so there is nothing else to restore.
+func resumeWatching() {
+	var invoices []Invoice
+	err := pg.Select(&invoices, `
+      SELECT `+INVOICEFIELDS+` FROM invoice
+      WHERE status IN ('pending', 'held')
+      ORDER BY creation DESC
+    `)
+	if err != nil {
+		log.Error().Err(err).Msg("error listing invoices to resume")
+		return
+	}
+
+	log.Info().Int("n", len(invoices)).Msg("resuming invoice watchers")
+	for _, inv := range invoices {
+		watchInvoice(inv)
+	}
+}
@@ -1,10 +1,60 @@
 package main
 
+import "strings"
+
+// expireInvoices archives unpaid invoices as expired instead of deleting
+// them. Hold invoices are cancelled by cancelStaleHolds instead.
+func expireInvoices() {
+	var hashes []string
+	err := pg.Select(&hashes, `
+      WITH expired AS (
+        UPDATE invoice
+        SET status = 'expired', status_changed = now()
+        WHERE status = 'pending' AND NOT hold
+          AND expires_at < now() - interval '1 minute'
+        RETURNING hash
+      )
+      INSERT INTO invoice_transition (hash, from_status, to_status)
+      SELECT hash, 'pending', 'expired' FROM expired
+      RETURNING hash
+    `)
+	if err != nil {
+		log.Error().Err(err).Msg("error expiring invoices")
+		return
+	}
+	if len(hashes) == 0 {
+		return
+	}
+
+	var invoices []Invoice
+	err = pg.Select(&invoices, `
+      SELECT `+INVOICEFIELDS+`
+      FROM invoice
+      WHERE hash = ANY(string_to_array($1, '|'))
+    `, strings.Join(hashes, "|"))
+	if err != nil {
+		log.Error().Err(err).Msg("error getting expired invoices")
+		return
+	}
+	for _, inv := range invoices {
+		emitEvent(inv.Shop, EVENT_INVOICE_EXPIRED, inv.Template, inv)
+	}
+}
+
+// cleanupInvoices deletes invoices that were never paid once they are older
+// than their shop's retention period.
 func cleanupInvoices() {
 	_, err := pg.Exec(`
-      DELETE FROM invoice
-      WHERE payment IS NULL
-        AND creation < now() - interval '1 hour'
+      WITH old AS (
+        SELECT hash FROM invoice
+        INNER JOIN shop ON shop.id = invoice.shop
+        WHERE invoice.status IN ('expired', 'cancelled', 'failed_to_create')
+          AND shop.retention_days IS NOT NULL
+          AND invoice.creation < now() - shop.retention_days * interval '1 day'
+      ), transitions AS (
+        DELETE FROM invoice_transition WHERE hash IN (SELECT hash FROM old)
+      )
+      DELETE FROM invoice WHERE hash IN (SELECT hash FROM old)
     `)
 	if err != nil {
 		log.Error().Err(err).Msg("error cleaning up invoices")
@@ -15,7 +65,7 @@ func checkOldInvoices() {
 	var invoices []Invoice
 	err := pg.Select(&invoices, `
       SELECT `+INVOICEFIELDS+` FROM invoice
-      WHERE payment IS NULL
+      WHERE status = 'pending'
     `)
 	if err != nil {
 		log.Error().Err(err).Msg("error checking old invoices")
@@ -23,7 +73,37 @@ func checkOldInvoices() {
 	}
 
 	for _, inv := range invoices {
+		if watching.Has(inv.Hash) {
+			continue
+		}
+
 		log.Debug().Str("bolt11", inv.Bolt11).Msg("checking old invoice")
 		go inv.Check()
 	}
 }
+
+// cancelStaleHolds cancels hold invoices the merchant didn't settle or cancel
+// in time, and those that were never paid, so no HTLC is stuck forever.
+func cancelStaleHolds() {
+	var invoices []Invoice
+	err := pg.Select(&invoices, `
+      SELECT `+INVOICEFIELDS+` FROM invoice
+      WHERE hold AND (
+        (status = 'pending' AND expires_at < now() - interval '1 minute') OR
+        (status = 'held' AND status_changed < now() - interval '1 hour')
+      )
+    `)
+	if err != nil {
+		log.Error().Err(err).Msg("error listing stale hold invoices")
+		return
+	}
+
+	for _, inv := range invoices {
+		err := inv.Cancel()
+		if err != nil {
+			log.Warn().Err(err).Str("hash", inv.Hash).Msg("failed to cancel stale hold invoice")
+			continue
+		}
+		log.Info().Str("hash", inv.Hash).Msg("cancelled stale hold invoice")
+	}
+}
@@ -23,9 +23,14 @@ type Template struct {
 	Currency    string               `db:"currency" json:"currency"`
 	MinPrice    string               `db:"min_price" json:"min_price"`
 	MaxPrice    string               `db:"max_price" json:"max_price"`
+	Hold        bool                 `db:"hold" json:"hold"`
+
+	InvoiceExpiry int `db:"invoice_expiry" json:"invoice_expiry"` // seconds
 }
 
-var TEMPLATEFIELDS = `id, shop, array_to_string(path_params, '|') AS path_params, array_to_string(query_params, '|') AS query_params, description, coalesce(image, '') AS image, currency, min_price, max_price`
+const DEFAULT_INVOICE_EXPIRY = 1800
+
+var TEMPLATEFIELDS = `id, shop, array_to_string(path_params, '|') AS path_params, array_to_string(query_params, '|') AS query_params, description, coalesce(image, '') AS image, currency, min_price, max_price, hold, invoice_expiry`
 
 func (t *Template) MakeURL(params map[string]string) string {
 	path := "/lnurl/p/" + t.Shop + "/" + t.Id + "/"
@@ -101,7 +106,7 @@ func (t Template) MakeInvoice(
 	params map[string]string,
 ) (invoice *Invoice, err error) {
 	// validate amount
-	min, max, err := t.GetPrices(params)
+	min, max, quote, err := t.GetPrices(params)
 	if err != nil {
 		return nil, fmt.Errorf("error getting prices: %w", err)
 	}
@@ -113,7 +118,7 @@ func (t Template) MakeInvoice(
 	encodedMetadata := t.EncodedMetadata(params)
 
 	// generate invoice and save invoice object
-	inv, err := NewInvoice(t.Id, t.Shop, amount, params, encodedMetadata)
+	inv, err := NewInvoice(t, amount, params, encodedMetadata, quote)
 	if err != nil {
 		return nil, fmt.Errorf("failed to make invoice: %w", err)
 	}
@@ -121,33 +126,40 @@ func (t Template) MakeInvoice(
 	return inv, nil
 }
 
-func (t *Template) GetPrices(params map[string]string) (min int64, max int64, err error) {
+// GetPrices returns the prices in msatoshi and the quote used to convert
+// them, which is nil when the template is priced in satoshis.
+func (t *Template) GetPrices(params map[string]string) (min int64, max int64, quote *FiatQuote, err error) {
 	names, values := paramsToJQVars(params)
 
 	// calculate raw prices
 	fmin, err1 := runJQPrice(t.MinPrice, names, values)
 	fmax, err2 := runJQPrice(t.MaxPrice, names, values)
 	if err1 != nil || err2 != nil {
-		return 0, 0, fmt.Errorf("min: %w, max: %w", err1, err2)
+		return 0, 0, nil, fmt.Errorf("min: %w, max: %w", err1, err2)
 	}
 
 	// convert to satoshis
 	var satoshis float64 = 1
 	if t.Currency != "sat" {
-		satoshis, err = getSatoshisPer(t.Currency)
+		q, err := getFiatQuote(t.Currency)
 		if err != nil {
-			return 0, 0, fmt.Errorf("failed to get %s price: %w", t.Currency, err)
+			return 0, 0, nil, fmt.Errorf("failed to get %s price: %w", t.Currency, err)
 		}
+		satoshis = q.SatoshisPerUnit()
+		quote = &q
 	}
 
-	return int64(fmin * satoshis * 1000), int64(fmax * satoshis * 1000), nil
+	return int64(fmin * satoshis * 1000), int64(fmax * satoshis * 1000), quote, nil
+}
+
+func (t *Template) RenderDescription(params map[string]string) string {
+	return mustache.Render(t.Description, params)
 }
 
 func (t *Template) EncodedMetadata(params map[string]string) string {
 	kv := make([][]string, 1, 2)
 
-	description := mustache.Render(t.Description, params)
-	kv[0] = []string{"text/plain", description}
+	kv[0] = []string{"text/plain", t.RenderDescription(params)}
 
 	if t.Image != "" {
 		// should be in format 'data:image/png;base64,...' (or jpeg)
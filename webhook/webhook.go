@@ -0,0 +1,109 @@
+// Package webhook verifies the webhooks sent by lnurlpayserver.
+//
+// Every webhook has these headers:
+//
+//	X-Webhook-Id: unique id of the event, the same on retries
+//	X-Webhook-Timestamp: unix time of this delivery attempt
+//	X-Webhook-Signature: v1=<hex hmac-sha256 of "<timestamp>.<body>">
+//
+// The signature header may have more than one comma-separated signature
+// while the shop is rotating its webhook secret. Receivers should check the
+// signature and reject old timestamps and ids they've already seen:
+//
+//	body, err := webhook.VerifyRequest(secret, r, 5*time.Minute)
+//	if err != nil {
+//	    w.WriteHeader(400)
+//	    return
+//	}
+//
+// The body is an Event, its data depends on the type and on the API version
+// the shop is pinned to.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	HeaderId        = "X-Webhook-Id"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+var (
+	ErrMissingHeaders   = errors.New("missing webhook headers")
+	ErrInvalidTimestamp = errors.New("invalid webhook timestamp")
+	ErrTooOld           = errors.New("webhook timestamp is outside the tolerance")
+	ErrInvalidSignature = errors.New("webhook signature doesn't match")
+)
+
+// Event is the body of every webhook. Its id is the same as the id header.
+type Event struct {
+	Id         string          `json:"id"`
+	Type       string          `json:"type"`
+	Created    time.Time       `json:"created"`
+	ApiVersion string          `json:"api_version"`
+	Data       json.RawMessage `json:"data"`
+}
+
+// Sign returns the signature for the given body, as it goes in the
+// signature header.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return "v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the headers of a webhook against its body. Timestamps further
+// than tolerance from now are rejected, a zero tolerance disables that check.
+func Verify(secret string, header http.Header, body []byte, tolerance time.Duration) error {
+	ts := header.Get(HeaderTimestamp)
+	signatures := header.Get(HeaderSignature)
+	if ts == "" || signatures == "" || header.Get(HeaderId) == "" {
+		return ErrMissingHeaders
+	}
+
+	timestamp, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return ErrInvalidTimestamp
+	}
+	if tolerance > 0 {
+		diff := time.Since(time.Unix(timestamp, 0))
+		if diff > tolerance || diff < -tolerance {
+			return ErrTooOld
+		}
+	}
+
+	expected := []byte(Sign(secret, timestamp, body))
+	for _, sig := range strings.Split(signatures, ",") {
+		if hmac.Equal([]byte(strings.TrimSpace(sig)), expected) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+// VerifyRequest reads the body of the request and verifies it. The body is
+// returned and also put back in the request so it can be read again.
+func VerifyRequest(secret string, r *http.Request, tolerance time.Duration) ([]byte, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	return body, Verify(secret, r.Header, body, tolerance)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx/types"
+)
+
+// deliveries are retried with exponential backoff until this old
+const webhookMaxAge = 72 * time.Hour
+
+type WebhookDelivery struct {
+	Id          string         `db:"id" json:"id"`
+	Webhook     *string        `db:"webhook" json:"webhook"`
+	EventId     string         `db:"event_id" json:"event_id"`
+	Event       string         `db:"event" json:"event"`
+	Shop        string         `db:"shop" json:"shop"`
+	URL         string         `db:"url" json:"url"`
+	Body        types.JSONText `db:"body" json:"body"`
+	Status      string         `db:"status" json:"status"` // pending, delivered or failed
+	Attempts    int            `db:"attempts" json:"attempts"`
+	Created     time.Time      `db:"created" json:"created"`
+	NextAttempt *time.Time     `db:"next_attempt" json:"next_attempt"`
+	Delivered   *time.Time     `db:"delivered" json:"delivered"`
+
+	AttemptLog []WebhookAttempt `db:"-" json:"attempt_log,omitempty"`
+}
+
+type WebhookAttempt struct {
+	Time       time.Time `db:"time" json:"time"`
+	StatusCode int       `db:"status_code" json:"status_code"`
+	LatencyMs  int64     `db:"latency_ms" json:"latency_ms"`
+	Response   string    `db:"response" json:"response"`
+	Error      string    `db:"error" json:"error,omitempty"`
+}
+
+const WEBHOOKDELIVERYFIELDS = `id, webhook, event_id, event, shop, url, body, status, attempts, created, next_attempt, delivered`
+
+// enqueueWebhook stores the delivery and tries it right away.
+func enqueueWebhook(endpoint WebhookEndpoint, event string, eventId string, body []byte) {
+	var id string
+	err := pg.Get(&id, `
+      INSERT INTO webhook_delivery (id, webhook, event_id, event, shop, url, body)
+      VALUES ($1, $2, $3, $4, $5, $6, $7)
+      RETURNING id
+    `, "whd_"+randomHex(12), endpoint.Id, eventId, event,
+		endpoint.Shop, endpoint.URL, types.JSONText(body))
+	if err != nil {
+		log.Error().Err(err).Str("shop", endpoint.Shop).Str("event", event).
+			Msg("failed to enqueue webhook")
+		return
+	}
+
+	go deliverWebhook(id)
+}
+
+// deliverWebhook makes one attempt if the delivery is due. The row is
+// claimed first so concurrent calls don't deliver it twice.
+func deliverWebhook(id string) {
+	var delivery WebhookDelivery
+	err := pg.Get(&delivery, `
+      UPDATE webhook_delivery
+      SET next_attempt = now() + interval '1 minute'
+      WHERE id = $1 AND status = 'pending' AND next_attempt <= now()
+      RETURNING `+WEBHOOKDELIVERYFIELDS, id)
+	if err != nil {
+		// not due or not found
+		return
+	}
+
+	var shop Shop
+	err = pg.Get(&shop, `SELECT `+SHOPFIELDS+` FROM shop WHERE id = $1`, delivery.Shop)
+	if err != nil {
+		log.Error().Err(err).Str("delivery", id).Msg("failed to get shop for webhook")
+		return
+	}
+
+	result, err := shop.postWebhook(delivery.URL, delivery.EventId, delivery.Body)
+	errMessage := ""
+	if err != nil {
+		errMessage = err.Error()
+	}
+
+	_, dberr := pg.Exec(`
+      INSERT INTO webhook_attempt (delivery, status_code, latency_ms, response, error)
+      VALUES ($1, $2, $3, $4, $5)
+    `, id, result.Status, result.Latency, result.Body, errMessage)
+	if dberr != nil {
+		log.Error().Err(dberr).Str("delivery", id).Msg("failed to log webhook attempt")
+	}
+
+	logger := log.With().Str("url", delivery.URL).Str("delivery", id).
+		Str("event", delivery.Event).Int("attempt", delivery.Attempts+1).Logger()
+
+	if err == nil {
+		_, err = pg.Exec(`
+          UPDATE webhook_delivery
+          SET status = 'delivered', delivered = now(), next_attempt = NULL,
+              attempts = attempts + 1
+          WHERE id = $1
+        `, id)
+		logger.Info().Msg("webhook dispatched")
+		return
+	}
+
+	// 30s, 1min, 2min, 4min... up to 6 hours between attempts
+	backoff := time.Duration(math.Min(
+		float64(30*time.Second)*math.Pow(2, float64(delivery.Attempts)),
+		float64(6*time.Hour),
+	))
+	next := time.Now().Add(backoff)
+	if next.Sub(delivery.Created) > webhookMaxAge {
+		_, err = pg.Exec(`
+          UPDATE webhook_delivery
+          SET status = 'failed', next_attempt = NULL, attempts = attempts + 1
+          WHERE id = $1
+        `, id)
+		logger.Warn().Err(err).Msg("webhook failed, giving up")
+		return
+	}
+
+	_, err = pg.Exec(`
+      UPDATE webhook_delivery
+      SET next_attempt = $2, attempts = attempts + 1
+      WHERE id = $1
+    `, id, next)
+	logger.Warn().Str("error", errMessage).Dur("backoff", backoff).
+		Msg("webhook failed, will retry")
+}
+
+// how many deliveries retryWebhooks makes at the same time
+const webhookRetryConcurrency = 10
+
+// retryWebhooks tries the deliveries that are due, the oldest one for each
+// url, so an endpoint that is down or slow doesn't hold back the others.
+func retryWebhooks() {
+	var ids []string
+	err := pg.Select(&ids, `
+      SELECT id FROM (
+        SELECT DISTINCT ON (url) id, next_attempt FROM webhook_delivery
+        WHERE status = 'pending' AND next_attempt <= now()
+        ORDER BY url, next_attempt
+      ) due
+      ORDER BY next_attempt
+      LIMIT 100
+    `)
+	if err != nil {
+		log.Error().Err(err).Msg("error listing webhooks to retry")
+		return
+	}
+
+	slots := make(chan struct{}, webhookRetryConcurrency)
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(id string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			deliverWebhook(id)
+		}(id)
+	}
+	wg.Wait()
+}
+
+// retriggerWebhook makes a delivery pending again and tries it now, even if
+// it was already delivered or has failed.
+func retriggerWebhook(shopId string, id string) error {
+	_, err := pg.Exec(`
+      UPDATE webhook_delivery
+      SET status = 'pending', next_attempt = now()
+      WHERE id = $1 AND shop = $2
+    `, id, shopId)
+	if err != nil {
+		return err
+	}
+
+	deliverWebhook(id)
+	return nil
+}
+
+func (delivery *WebhookDelivery) loadAttempts() error {
+	delivery.AttemptLog = make([]WebhookAttempt, 0)
+	return pg.Select(&delivery.AttemptLog, `
+      SELECT time, status_code, latency_ms, response, error
+      FROM webhook_attempt
+      WHERE delivery = $1
+      ORDER BY time
+    `, delivery.Id)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/fiatjaf/lnurlpayserver/webhook"
+	"github.com/jmoiron/sqlx/types"
+)
+
+// after a rotation webhooks are signed with both secrets for this long
+const webhookSecretOverlap = 24 * time.Hour
+
+var webhookClient = &http.Client{Timeout: 15 * time.Second}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func newWebhookSecret() string {
+	return "whsec_" + randomHex(32)
+}
+
+func newEventId() string {
+	return "evt_" + randomHex(16)
+}
+
+// webhookSignature signs with the current secret and, right after a
+// rotation, also with the previous one.
+func (shop Shop) webhookSignature(timestamp int64, body []byte) string {
+	signature := webhook.Sign(shop.WebhookSecret, timestamp, body)
+	if shop.OldWebhookSecret != "" && shop.WebhookSecretRotated != nil &&
+		time.Since(*shop.WebhookSecretRotated) < webhookSecretOverlap {
+		signature += "," + webhook.Sign(shop.OldWebhookSecret, timestamp, body)
+	}
+	return signature
+}
+
+type webhookResult struct {
+	Status  int    `json:"status"`
+	Latency int64  `json:"latency_ms"`
+	Body    string `json:"body"`
+}
+
+// postWebhook makes a single signed delivery attempt.
+func (shop Shop) postWebhook(url string, eventId string, body []byte) (webhookResult, error) {
+	var result webhookResult
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return result, err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhook.HeaderId, eventId)
+	req.Header.Set(webhook.HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(webhook.HeaderSignature, shop.webhookSignature(timestamp, body))
+
+	start := time.Now()
+	resp, err := webhookClient.Do(req)
+	result.Latency = time.Since(start).Milliseconds()
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+
+	snippet, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1000))
+	result.Status = resp.StatusCode
+	result.Body = string(snippet)
+	if resp.StatusCode >= 300 {
+		return result, fmt.Errorf("webhook returned %d", resp.StatusCode)
+	}
+	return result, nil
+}
+
+// testInvoice makes up an invoice from the template as it would be at the
+// moment of the given event. It is flagged as "test" and never saved.
+func testInvoice(t Template, event string) Invoice {
+	params := make(map[string]string)
+	for _, name := range append(t.PathParams, t.QueryParams...) {
+		params[name] = "test"
+	}
+	jparams, _ := json.Marshal(params)
+
+	preimage, _ := hex.DecodeString(randomHex(32))
+	hash := sha256.Sum256(preimage)
+
+	now := time.Now()
+	expiry := t.InvoiceExpiry
+	if expiry == 0 {
+		expiry = DEFAULT_INVOICE_EXPIRY
+	}
+
+	inv := Invoice{
+		Hash:        hex.EncodeToString(hash[:]),
+		Preimage:    hex.EncodeToString(preimage),
+		Shop:        t.Shop,
+		Template:    t.Id,
+		Params:      types.JSONText(jparams),
+		AmountMsat:  1000,
+		Description: t.RenderDescription(params),
+		Currency:    t.Currency,
+		Creation:    now,
+		ExpiresAt:   now.Add(time.Duration(expiry) * time.Second),
+		Hold:        t.Hold,
+		StatusTime:  now,
+		Flags:       DelimitedStringArray{"test"},
+		template:    &t,
+	}
+
+	// the template prices may not work with made up params
+	if min, _, quote, err := t.GetPrices(params); err == nil && min > 0 {
+		inv.AmountMsat = min
+		if quote != nil {
+			fiat := float64(min) / 1000 / quote.SatoshisPerUnit()
+			inv.FiatAmount, inv.Rate = &fiat, &quote.Rate
+			inv.RateSource, inv.RateTime = &quote.Source, &quote.Time
+		}
+	}
+
+	switch event {
+	case EVENT_INVOICE_CREATED:
+		inv.Status = INVOICE_PENDING
+	case EVENT_INVOICE_HELD:
+		inv.Status = INVOICE_HELD
+	case EVENT_INVOICE_EXPIRED:
+		inv.Status = INVOICE_EXPIRED
+		inv.Creation = now.Add(-time.Duration(expiry) * time.Second)
+		inv.ExpiresAt = now
+	default:
+		confirmed := true
+		inv.Status = INVOICE_PAID
+		inv.Payment = &now
+		inv.AmountPaidMsat = &inv.AmountMsat
+		inv.PreimageConfirmed = &confirmed
+	}
+
+	return inv
+}